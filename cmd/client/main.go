@@ -216,13 +216,14 @@ func createTransaction(senderPubKey, privateKey, receiverPubKey string) (*blockc
 	receiverAddress := crypto.Key2Addr(receiverPubKey)
 
 	amountToSend := rand.Int63n(5) + 1
+	fee := rand.Int63n(3)
 
-	selectedUTXOs, err := utxoSet.GetUTXOs(senderAddress, amountToSend)
+	selectedUTXOs, err := utxoSet.GetUTXOs(senderAddress, amountToSend+fee)
 	if err != nil {
 		return nil, fmt.Errorf("failed to select UTXOs: %w", err)
 	}
 
-	tx, err := blockchain.NewTransaction(selectedUTXOs, senderPubKey, receiverPubKey, amountToSend)
+	tx, err := blockchain.NewTransaction(selectedUTXOs, senderPubKey, receiverPubKey, amountToSend, fee)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create transaction: %w", err)
 	}
@@ -231,7 +232,7 @@ func createTransaction(senderPubKey, privateKey, receiverPubKey string) (*blockc
 		return nil, fmt.Errorf("failed to sign transaction: %w", err)
 	}
 
-	logger.InfoLogger.Printf("[Client] Successfully created transaction from %s to %s for amount: %d", senderAddress, receiverAddress, amountToSend)
+	logger.InfoLogger.Printf("[Client] Successfully created transaction from %s to %s for amount: %d, fee: %d", senderAddress, receiverAddress, amountToSend, fee)
 
 	return tx, nil
 }
@@ -5,6 +5,7 @@ import (
     "bufio"
     "context"
     "encoding/json"
+    "errors"
     "fmt"
     "math/rand"
     "nakamoto-blockchain/internal/blockchain"
@@ -25,6 +26,7 @@ import (
 var (
     mu      sync.Mutex
     utxoSet = blockchain.NewUTXOSet()
+    pending = make(map[string]*blockchain.Transaction) // transactions sent by this client, by hash
 )
 
 func main() {
@@ -62,7 +64,10 @@ func main() {
         fmt.Println("1) Send new transaction")
         fmt.Println("2) Check transaction status (k=3)")
         fmt.Println("3) Get current balance (local)")
-        fmt.Println("4) Quit")
+        fmt.Println("4) Bump fee of a sent transaction")
+        fmt.Println("5) Cancel a sent transaction")
+        fmt.Println("6) Verify a transaction is in a block (Merkle proof)")
+        fmt.Println("7) Quit")
         fmt.Print("Enter choice: ")
 
         var choice string
@@ -76,6 +81,12 @@ func main() {
         case "3":
             handleGetBalance()
         case "4":
+            handleReplaceTransaction(keyMap, minerIPs, false)
+        case "5":
+            handleReplaceTransaction(keyMap, minerIPs, true)
+        case "6":
+            handleVerifyInclusion(minerIPs)
+        case "7":
             fmt.Println("[Client UI] Exiting...")
             return
         default:
@@ -110,6 +121,19 @@ func handleSendTransaction(keyMap map[string]string, minerIPs []string) {
         return
     }
 
+    // Prompt fee
+    fmt.Print("Enter fee (default 0): ")
+    feeStr, _ := reader.ReadString('\n')
+    feeStr = strings.TrimSpace(feeStr)
+    var fee int64
+    if feeStr != "" {
+        fee, err = strconv.ParseInt(feeStr, 10, 64)
+        if err != nil || fee < 0 {
+            fmt.Println("Invalid fee.")
+            return
+        }
+    }
+
     // Acquire private key
     privateKey, ok := keyMap[senderPubKey]
     if !ok {
@@ -122,13 +146,13 @@ func handleSendTransaction(keyMap map[string]string, minerIPs []string) {
     defer mu.Unlock()
 
     senderAddress := crypto.Key2Addr(senderPubKey)
-    selectedUTXOs, err := utxoSet.GetUTXOs(senderAddress, amountToSend)
+    selectedUTXOs, err := utxoSet.GetUTXOs(senderAddress, amountToSend+fee)
     if err != nil {
         fmt.Printf("Failed to select UTXOs: %v\n", err)
         return
     }
 
-    tx, err := blockchain.NewTransaction(selectedUTXOs, senderPubKey, recipientPubKey, amountToSend)
+    tx, err := blockchain.NewTransaction(selectedUTXOs, senderPubKey, recipientPubKey, amountToSend, fee)
     if err != nil {
         fmt.Printf("Failed to create transaction: %v\n", err)
         return
@@ -152,10 +176,113 @@ func handleSendTransaction(keyMap map[string]string, minerIPs []string) {
         fmt.Printf("Failed to update UTXOSet: %v\n", err)
         return
     }
+    pending[tx.Hash] = tx
 
     fmt.Printf("Transaction %s sent successfully to miner %s.\n", tx.Hash, minerIP)
 }
 
+// handleReplaceTransaction replaces a transaction sent by this client that is
+// not mined yet with one spending the same inputs for a higher fee. A bump
+// keeps the payments and takes the extra fee from the change, a cancellation
+// pays everything back to the sender.
+func handleReplaceTransaction(keyMap map[string]string, minerIPs []string, cancel bool) {
+    reader := bufio.NewReader(os.Stdin)
+
+    fmt.Print("Enter hash of the sent transaction: ")
+    txHash, _ := reader.ReadString('\n')
+    txHash = strings.TrimSpace(txHash)
+
+    mu.Lock()
+    defer mu.Unlock()
+
+    original, ok := pending[txHash]
+    if !ok {
+        fmt.Println("Transaction was not sent by this client.")
+        return
+    }
+
+    fmt.Printf("Enter new fee (current fee %d, replacements must pay about %d more): ", original.Fee(), blockchain.ReplacementFeeBump(original.Size()))
+    feeStr, _ := reader.ReadString('\n')
+    fee, err := strconv.ParseInt(strings.TrimSpace(feeStr), 10, 64)
+    if err != nil || fee <= original.Fee() {
+        fmt.Println("Invalid fee.")
+        return
+    }
+
+    privateKey, ok := keyMap[original.Content.SenderPubKey]
+    if !ok {
+        fmt.Println("Sender key not found in keys file.")
+        return
+    }
+
+    senderAddress := crypto.Key2Addr(original.Content.SenderPubKey)
+    var payments []blockchain.Payment
+    if cancel {
+        var totalInput int64
+        for _, utxo := range original.Content.InputUTXOs {
+            totalInput += utxo.Amount
+        }
+        payments = append(payments, blockchain.Payment{Address: senderAddress, Amount: totalInput - fee})
+    } else {
+        // Transactions sent by this client pay a single recipient, followed by
+        // the change that NewBatchTransaction appends. Every other output is
+        // kept as is, even one paying the sender, and the change is rebuilt
+        // with the higher fee taken from it.
+        const changeIndex = 1
+        for i, utxo := range original.Content.OutputUTXOs {
+            if i != changeIndex {
+                payments = append(payments, blockchain.Payment{Address: utxo.Address, Amount: utxo.Amount, LockScript: utxo.LockScript, LockTime: utxo.LockTime})
+            }
+        }
+    }
+
+    tx, err := blockchain.NewBatchTransaction(original.Content.InputUTXOs, original.Content.SenderPubKey, payments, fee)
+    if err != nil {
+        fmt.Printf("Failed to create transaction: %v\n", err)
+        return
+    }
+    if err := tx.Sign(privateKey); err != nil {
+        fmt.Printf("Failed to sign transaction: %v\n", err)
+        return
+    }
+    if required := original.Fee() + blockchain.ReplacementFeeBump(tx.Size()); fee < required {
+        fmt.Printf("Fee too low, the replacement must pay at least %d.\n", required)
+        return
+    }
+
+    // The outputs of the original must still be unspent locally to undo it
+    for i := range original.Content.OutputUTXOs {
+        utxo, _ := original.GetUTXO(i)
+        if !utxoSet.CheckUTXO(utxo) {
+            fmt.Println("Outputs of the transaction were already spent, it cannot be replaced.")
+            return
+        }
+    }
+
+    minerIP := minerIPs[rand.Intn(len(minerIPs))]
+    if err := sendTransactionToMiner(server.ConvertTransactionToGrpc(tx), minerIP+":50051"); err != nil {
+        fmt.Printf("Failed to send transaction to %s: %v\n", minerIP, err)
+        return
+    }
+
+    // Update local UTXO set
+    for i := range original.Content.OutputUTXOs {
+        utxo, _ := original.GetUTXO(i)
+        utxoSet.RemoveUTXO(utxo)
+    }
+    for _, utxo := range original.Content.InputUTXOs {
+        utxoSet.AddUTXO(utxo)
+    }
+    if err := utxoSet.AddTransaction(*tx); err != nil {
+        fmt.Printf("Failed to update UTXOSet: %v\n", err)
+        return
+    }
+    delete(pending, original.Hash)
+    pending[tx.Hash] = tx
+
+    fmt.Printf("Transaction %s replaced by %s on miner %s.\n", original.Hash, tx.Hash, minerIP)
+}
+
 func handleCheckStatus(minerIPs []string) {
     reader := bufio.NewReader(os.Stdin)
     fmt.Print("Enter transaction hash to check: ")
@@ -182,6 +309,60 @@ func handleCheckStatus(minerIPs []string) {
     }
 }
 
+// handleVerifyInclusion fetches a Merkle proof for a transaction and checks it
+// locally against the block header, as a light client would, instead of
+// trusting the miner's answer.
+func handleVerifyInclusion(minerIPs []string) {
+    reader := bufio.NewReader(os.Stdin)
+    fmt.Print("Enter transaction hash to verify: ")
+    txHash, _ := reader.ReadString('\n')
+    txHash = strings.TrimSpace(txHash)
+
+    miner := minerIPs[0]
+    proof, header, blockHash, err := getMerkleProofRPC(txHash, miner+":50051")
+    if err != nil {
+        fmt.Printf("Error getting proof from miner %s: %v\n", miner, err)
+        return
+    }
+
+    block := blockchain.Block{Header: *header}
+    hash, err := block.CalculateHash()
+    if err != nil || hash != blockHash || !block.VerifyHash(hash) {
+        fmt.Printf("Header of block %s returned by miner %s is invalid.\n", blockHash, miner)
+        return
+    }
+    if !blockchain.VerifyMerkleProof(header, proof) {
+        fmt.Printf("Proof for transaction %s from miner %s is invalid.\n", txHash, miner)
+        return
+    }
+    fmt.Printf("Transaction %s is transaction %d of %d in block %s at height %d.\n", txHash, proof.Index, proof.Count, blockHash, header.Height)
+}
+
+func getMerkleProofRPC(txHash, minerAddr string) (*blockchain.MerkleProof, *blockchain.BlockHeader, string, error) {
+    conn, err := grpc.Dial(minerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+    if err != nil {
+        return nil, nil, "", fmt.Errorf("failed to connect to miner at %s: %w", minerAddr, err)
+    }
+    defer conn.Close()
+
+    client := gen.NewIncomingCommunicatorServiceClient(conn)
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    resp, err := client.GetMerkleProof(ctx, &gen.MerkleProofRequest{TxHash: txHash})
+    if err != nil {
+        return nil, nil, "", fmt.Errorf("GetMerkleProof RPC error: %w", err)
+    }
+    if resp.Error != "" {
+        return nil, nil, "", errors.New(resp.Error)
+    }
+    proof, header := server.ConvertGrpcToMerkleProof(txHash, resp)
+    if header == nil {
+        return nil, nil, "", fmt.Errorf("proof without block header")
+    }
+    return proof, header, resp.BlockHash, nil
+}
+
 func handleGetBalance() {
     reader := bufio.NewReader(os.Stdin)
     fmt.Print("Enter public key to see current local balance: ")
@@ -1,51 +1,102 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"google.golang.org/grpc"
 
 	"nakamoto-blockchain/internal/blockchain"
+	"nakamoto-blockchain/internal/crypto"
 	"nakamoto-blockchain/internal/server"
 	"nakamoto-blockchain/logger"
 	"nakamoto-blockchain/proto/gen"
 )
 
 func main() {
+	dataDir := flag.String("datadir", "./chaindata", "Directory where the miner persists its chain")
+	rewardAddress := flag.String("address", "", "Address receiving block rewards (default: a key kept in the data directory)")
+	blockSize := flag.Int("blocksize", blockchain.MaxBlockSize, "Maximum size in bytes of mined blocks")
+	mempoolSize := flag.Int("mempoolsize", blockchain.MaxPoolSize, "Maximum size in bytes of the transaction pool")
+	mempoolExpiry := flag.Duration("mempoolexpiry", blockchain.PoolExpiry, "Time after which unmined transactions are dropped from the pool")
+	legacyEncoding := flag.Bool("legacyencoding", false, "Create blocks and transactions with legacy JSON hashes, for networks with miners not supporting the canonical encoding yet")
+	flag.Parse()
+
 	logger.Init()
-	if len(os.Args) < 5 {
-		logger.ErrorLogger.Fatal("[Server] Usage: go run main.go <initial_UTXOs> <httpServer_port> <grpc_port> <mode> <peer1> <peer2> ...")
+	args := flag.Args()
+	if len(args) < 4 {
+		logger.ErrorLogger.Fatal("[Server] Usage: go run main.go [-datadir dir] [-address addr] [-blocksize bytes] [-mempoolsize bytes] [-mempoolexpiry duration] [-legacyencoding] <initial_UTXOs> <httpServer_port> <grpc_port> <mode> <peer1> <peer2> ...")
 	}
 
-	utxoFile := os.Args[1]
-	httpPort := os.Args[2]
-	grpcPort := os.Args[3]
-	mode, _ := strconv.Atoi(os.Args[4])
-	peerAddresses := os.Args[5:]
+	utxoFile := args[0]
+	httpPort := args[1]
+	grpcPort := args[2]
+	mode, _ := strconv.Atoi(args[3])
+	peerAddresses := args[4:]
 
 	logger.InfoLogger.Printf("[Server] Starting miner with gRPC port: %s and peers: %v", grpcPort, peerAddresses)
+	if *legacyEncoding {
+		blockchain.EncodingVersion = blockchain.LegacyEncoding
+		logger.InfoLogger.Println("[Server] Creating blocks and transactions with the legacy encoding")
+	}
 
 	utxos := loadUTXOs(utxoFile)
 	peerManager := server.NewPeerManager()
 	peerManager.AddPeers(peerAddresses)
 
+	store, err := blockchain.OpenFileBlockStore(*dataDir)
+	if err != nil {
+		logger.ErrorLogger.Fatalf("[Server] Failed to open block store: %v", err)
+	}
+	snapshots, err := blockchain.OpenSnapshotStore(filepath.Join(*dataDir, "snapshots"))
+	if err != nil {
+		logger.ErrorLogger.Fatalf("[Server] Failed to open snapshot store: %v", err)
+	}
+	bc, err := blockchain.OpenBlockchain(utxos, store, snapshots)
+	if err != nil {
+		logger.ErrorLogger.Fatalf("[Server] Failed to load blockchain: %v", err)
+	}
+
+	if *rewardAddress == "" {
+		*rewardAddress = loadRewardAddress(*dataDir)
+	}
+	logger.InfoLogger.Printf("[Server] Block rewards are paid to %s", *rewardAddress)
+
 	outgoingComms := server.OutgoingCommunicator{PeerManager: peerManager}
-	blockchainServer := server.NewBlockchainServer(outgoingComms, peerManager, utxos, mode)
+	blockchainServer := server.NewBlockchainServer(outgoingComms, peerManager, bc, mode, *rewardAddress)
 	incomingComms := &server.IncomingCommunicator{Node: blockchainServer}
 
+	if *blockSize > blockchain.MaxBlockSize {
+		logger.ErrorLogger.Fatalf("[Server] Block size limit %d exceeds the maximum block size %d", *blockSize, blockchain.MaxBlockSize)
+	}
+	blockchainServer.BlockSizeLimit = *blockSize
+	blockchainServer.TxPool.MaxSize = *mempoolSize
+	blockchainServer.TxPool.Expiry = *mempoolExpiry
+
+	// Answer peers while syncing, so nodes starting together can sync from
+	// each other
+	go startHTTPServer(httpPort, blockchainServer)
+	go startGRPCServer(grpcPort, incomingComms)
+
+	// Catch up with the peers first, rather than mining on an outdated tip
+	blockchainServer.Sync()
+
 	// Start mining immediately
 	logger.InfoLogger.Println("[Server] Starting mining immediately")
 	if err := blockchainServer.MineBlocks(); err != nil {
 		logger.ErrorLogger.Fatalf("[Server] Failed to start mining: %v", err)
 	}
 
-	go startHTTPServer(httpPort, blockchainServer)
-	go startGRPCServer(grpcPort, incomingComms)
-
 	logger.InfoLogger.Println("[Server] Server is running and mining...")
 	select {} // Block forever instead of using wait group
 }
@@ -78,10 +129,56 @@ func loadUTXOs(utxoFile string) []blockchain.UTXO {
 	return utxos
 }
 
+// loadRewardAddress returns the address of the miner's reward key in dataDir,
+// generating the key on first start.
+func loadRewardAddress(dataDir string) string {
+	keyFile := filepath.Join(dataDir, "reward_key.json")
+
+	var keyPair struct {
+		PublicKey  string `json:"public_key"`
+		PrivateKey string `json:"private_key"`
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &keyPair); err != nil {
+			logger.ErrorLogger.Fatalf("[Server] Failed to decode reward key: %v", err)
+		}
+		return crypto.Key2Addr(keyPair.PublicKey)
+	}
+	if !os.IsNotExist(err) {
+		logger.ErrorLogger.Fatalf("[Server] Failed to read reward key: %v", err)
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		logger.ErrorLogger.Fatalf("[Server] Failed to generate reward key: %v", err)
+	}
+	privateKeyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		logger.ErrorLogger.Fatalf("[Server] Failed to encode reward key: %v", err)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		logger.ErrorLogger.Fatalf("[Server] Failed to encode reward key: %v", err)
+	}
+	keyPair.PublicKey = base64.StdEncoding.EncodeToString(publicKeyBytes)
+	keyPair.PrivateKey = base64.StdEncoding.EncodeToString(privateKeyBytes)
+
+	data, _ = json.MarshalIndent(keyPair, "", "    ")
+	if err := os.WriteFile(keyFile, data, 0600); err != nil {
+		logger.ErrorLogger.Fatalf("[Server] Failed to save reward key: %v", err)
+	}
+
+	logger.InfoLogger.Printf("[Server] Generated reward key in %s", keyFile)
+	return crypto.Key2Addr(keyPair.PublicKey)
+}
+
 func startHTTPServer(httpPort string, blockchainServer *server.BlockchainServer) {
 	http.HandleFunc("/addpeers", handleAddPeers(blockchainServer))
 	http.HandleFunc("/mineblocks", handleMineBlocks(blockchainServer))
 	http.HandleFunc("/stopmining", handleStopMining(blockchainServer))
+	http.HandleFunc("/mempool", handleMempool(blockchainServer))
 
 	logger.InfoLogger.Printf("[HTTP Server] Listening on port %s", httpPort)
 	if err := http.ListenAndServe(":"+httpPort, nil); err != nil {
@@ -154,6 +251,18 @@ func handleStopMining(blockchainServer *server.BlockchainServer) http.HandlerFun
 	}
 }
 
+func handleMempool(blockchainServer *server.BlockchainServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(blockchainServer.MempoolStats())
+	}
+}
+
 func startGRPCServer(grpcPort string, incomingComms *server.IncomingCommunicator) {
 	listener, err := net.Listen("tcp", ":"+grpcPort)
 	if err != nil {
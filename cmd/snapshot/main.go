@@ -0,0 +1,258 @@
+/*
+Offline management of the UTXO snapshots a miner keeps in its data directory.
+Should be run while the miner using the data directory is stopped.
+
+Commands:
+1. create: rebuilds the chain state from the block store and snapshots the UTXO set at the tip.
+2. list: lists the stored snapshots with their height, block hash and checksum status.
+3. verify: checks every snapshot (or the one given by -height) against its checksum, the stored chain,
+   and the UTXO set obtained by replaying the chain from the initial UTXOs.
+4. migrate: rewrites blocks stored as JSON by older miners in the canonical binary encoding.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"nakamoto-blockchain/internal/blockchain"
+	"nakamoto-blockchain/logger"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	command := os.Args[1]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	dataDir := flags.String("datadir", "./chaindata", "Miner data directory")
+	utxoFile := flags.String("utxos", "./config/initial_utxos.json", "Initial UTXOs the chain was started with")
+	height := flags.Int("height", -1, "Only verify the snapshot at this height")
+	flags.Parse(os.Args[2:])
+
+	logger.Init()
+
+	var err error
+	switch command {
+	case "create":
+		err = createSnapshot(*dataDir, *utxoFile)
+	case "list":
+		err = listSnapshots(*dataDir)
+	case "verify":
+		err = verifySnapshots(*dataDir, *utxoFile, *height)
+	case "migrate":
+		err = migrateStore(*dataDir)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Println("Usage: go run ./cmd/snapshot <create|list|verify|migrate> [-datadir dir] [-utxos initial_utxos.json] [-height n]")
+	os.Exit(2)
+}
+
+func openStores(dataDir string) (*blockchain.FileBlockStore, *blockchain.SnapshotStore, error) {
+	store, err := blockchain.OpenFileBlockStore(dataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshots, err := blockchain.OpenSnapshotStore(filepath.Join(dataDir, "snapshots"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, snapshots, nil
+}
+
+func createSnapshot(dataDir, utxoFile string) error {
+	utxos, err := loadUTXOs(utxoFile)
+	if err != nil {
+		return err
+	}
+
+	store, snapshots, err := openStores(dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	bc, err := blockchain.OpenBlockchain(utxos, store, snapshots)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := bc.SaveSnapshot()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created snapshot at height %d (block %s) with %d UTXOs\n", snapshot.Height, snapshot.BlockHash, len(snapshot.UTXOs))
+	return nil
+}
+
+func listSnapshots(dataDir string) error {
+	store, snapshots, err := openStores(dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	blocks, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	heights, err := snapshots.Heights()
+	if err != nil {
+		return err
+	}
+	if len(heights) == 0 {
+		fmt.Println("No snapshots found.")
+		return nil
+	}
+
+	for _, height := range heights {
+		snapshot, err := snapshots.Load(height)
+		if err != nil {
+			fmt.Printf("Height %d: unreadable (%v)\n", height, err)
+			continue
+		}
+		inChain := height < len(blocks) && blocks[height].Hash == snapshot.BlockHash
+		fmt.Printf("Height %d: block %s, %d UTXOs, checksum ok: %t, on stored chain: %t\n",
+			snapshot.Height, snapshot.BlockHash, len(snapshot.UTXOs), snapshot.Verify(), inChain)
+	}
+	return nil
+}
+
+func verifySnapshots(dataDir, utxoFile string, onlyHeight int) error {
+	utxos, err := loadUTXOs(utxoFile)
+	if err != nil {
+		return err
+	}
+
+	store, snapshots, err := openStores(dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	blocks, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	heights, err := snapshots.Heights()
+	if err != nil {
+		return err
+	}
+	if onlyHeight >= 0 {
+		heights = []int{onlyHeight}
+	}
+	sort.Ints(heights)
+
+	// Replay the chain once, comparing each snapshot as its height is reached
+	utxoSet := blockchain.NewUTXOSet()
+	for _, utxo := range utxos {
+		utxoSet.AddUTXO(utxo)
+	}
+	replayed := 0
+
+	failures := 0
+	for _, height := range heights {
+		snapshot, err := snapshots.Load(height)
+		if err != nil {
+			fmt.Printf("Height %d: FAILED, %v\n", height, err)
+			failures++
+			continue
+		}
+
+		if !snapshot.Verify() {
+			fmt.Printf("Height %d: FAILED, checksum mismatch\n", height)
+			failures++
+			continue
+		}
+
+		if height >= len(blocks) || blocks[height].Hash != snapshot.BlockHash {
+			fmt.Printf("Height %d: FAILED, block %s is not on the stored chain\n", height, snapshot.BlockHash)
+			failures++
+			continue
+		}
+
+		for ; replayed < height; replayed++ {
+			if err := utxoSet.AddBlock(blocks[replayed+1]); err != nil {
+				return fmt.Errorf("failed to replay block %d: %v", replayed+1, err)
+			}
+		}
+
+		expected := blockchain.NewUTXOSnapshot(height, blocks[height].Hash, utxoSet)
+		if expected.Checksum != snapshot.Checksum {
+			fmt.Printf("Height %d: FAILED, UTXO set does not match the replayed chain\n", height)
+			failures++
+			continue
+		}
+
+		fmt.Printf("Height %d: OK (%d UTXOs)\n", height, len(snapshot.UTXOs))
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d snapshot(s) failed verification", failures)
+	}
+	return nil
+}
+
+func migrateStore(dataDir string) error {
+	store, snapshots, err := openStores(dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	migrated, err := store.Migrate()
+	if err != nil {
+		return err
+	}
+	// Legacy snapshots are not read anymore, drop them so create can replace them
+	heights, err := snapshots.Heights()
+	if err != nil {
+		return err
+	}
+	if err := snapshots.Prune(len(heights)); err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %d block(s) to the canonical encoding\n", migrated)
+	return nil
+}
+
+func loadUTXOs(utxoFile string) ([]blockchain.UTXO, error) {
+	file, err := os.Open(utxoFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UTXO file: %v", err)
+	}
+	defer file.Close()
+
+	var entries []struct {
+		PublicKey string            `json:"public_key"`
+		UTXOs     []blockchain.UTXO `json:"utxos"`
+	}
+	if err := json.NewDecoder(file).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to decode UTXO file: %v", err)
+	}
+
+	var utxos []blockchain.UTXO
+	for _, entry := range entries {
+		utxos = append(utxos, entry.UTXOs...)
+	}
+	return utxos, nil
+}
@@ -3,12 +3,12 @@ module nakamoto-blockchain
 go 1.21
 
 require (
-	google.golang.org/grpc v1.58.3
+	google.golang.org/grpc v1.64.0
 	google.golang.org/protobuf v1.35.2
 )
 
 require (
-	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/golang/protobuf v1.5.4 // indirect
 	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
@@ -8,7 +8,11 @@ import (
 	"time"
 )
 
+// MaxBlockSize is the largest encoded block, in bytes, that nodes accept.
+var MaxBlockSize = 1000000
+
 type BlockHeader struct {
+	Version      int `json:",omitempty"` // encoding version, see EncodingVersion
 	Timestamp    int64
 	PreviousHash string
 	ContentHash  string
@@ -34,29 +38,42 @@ func (b *Block) CalculateContentHash() (string, error) {
 	// }
 
 	var transactionHashes []string
-	for _, tx := range b.Content.Transactions {
+	for i, tx := range b.Content.Transactions {
 		if tx.Hash == "" {
 			return "", errors.New("transaction hash is empty")
 		}
-		if !tx.Verify() {
+		if tx.Content.Version > b.Header.Version {
+			return "", errors.New("transaction version above block version")
+		}
+		if i == 0 && tx.IsCoinbase() {
+			if !tx.VerifyCoinbase(b.Header.Height) {
+				return "", errors.New("coinbase verification failed")
+			}
+		} else if !tx.Verify() {
 			return "", errors.New("transaction verification failed")
 		}
 		transactionHashes = append(transactionHashes, tx.Hash)
 	}
-	contentHashString := strings.Join(transactionHashes, "")
-	contentHash, err := crypto.Hash(contentHashString)
-	if err != nil {
-		return "", err
+	if b.Header.Version == LegacyEncoding {
+		return crypto.Hash(strings.Join(transactionHashes, ""))
 	}
-	return contentHash, nil
+	return MerkleRoot(transactionHashes)
+}
+
+// TransactionHashes returns the hashes of the block's transactions in order.
+func (b *Block) TransactionHashes() []string {
+	hashes := make([]string, len(b.Content.Transactions))
+	for i, tx := range b.Content.Transactions {
+		hashes[i] = tx.Hash
+	}
+	return hashes
 }
 
 func (b *Block) CalculateHash() (string, error) {
-	blockHash, err := crypto.Hash(b.Header)
-	if err != nil {
-		return "", err
+	if b.Header.Version == LegacyEncoding {
+		return crypto.Hash(b.Header)
 	}
-	return blockHash, nil
+	return crypto.HashBytes(b.Header.Encode()), nil
 }
 
 func (b *Block) VerifyHash(hash string) bool {
@@ -69,7 +86,48 @@ func (b *Block) VerifyHash(hash string) bool {
 	return hashBigInt.Cmp(difficultyBigInt) < 0
 }
 
+// Work is the expected number of hashes needed to mine a block with this
+// header's difficulty, 2^256 / target.
+func (h *BlockHeader) Work() *big.Int {
+	target := new(big.Int)
+	if _, ok := target.SetString(h.Difficulty, 16); !ok || target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	return new(big.Int).Div(maxHashValue, target)
+}
+
+var maxHashValue = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// VerifyReward checks that the block starts with a coinbase claiming at most the
+// subsidy plus the fees of the other transactions.
+func (b *Block) VerifyReward() bool {
+	if len(b.Content.Transactions) == 0 || !b.Content.Transactions[0].IsCoinbase() {
+		return false
+	}
+
+	reward, ok := b.Reward()
+	if !ok {
+		return false
+	}
+	claimed, ok := sumAmounts(b.Content.Transactions[0].Content.OutputUTXOs)
+	return ok && claimed <= reward
+}
+
+// Size returns the length in bytes of the canonical encoding of the block, as
+// stored on disk.
+func (b *Block) Size() int {
+	return len(encodeBlock(b))
+}
+
 func (b *Block) Verify() bool {
+	if b.Size() > MaxBlockSize {
+		return false
+	}
+
+	if !b.VerifyReward() {
+		return false
+	}
+
 	contentHash, err := b.CalculateContentHash()
 
 	if err != nil {
@@ -95,6 +153,7 @@ func (b *Block) Verify() bool {
 func NewBlock(previousHash string, height int, difficulty string, transactions []Transaction) (*Block, error) {
 	block := &Block{
 		Header: BlockHeader{
+			Version:      EncodingVersion,
 			Timestamp:    time.Now().UnixMilli(),
 			PreviousHash: previousHash,
 			Height:       height,
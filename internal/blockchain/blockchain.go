@@ -1,46 +1,157 @@
 package blockchain
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"nakamoto-blockchain/logger"
 	"strings"
 )
 
+// txLocation is the position of a transaction in the main chain.
+type txLocation struct {
+	blockHash string
+	index     int
+}
+
 type Blockchain struct {
-	Blocks  []*Block
-	UTXOSet *UTXOSet
+	Blocks    []*Block
+	UTXOSet   *UTXOSet
+	index     *BlockIndex    // every known block, including side branches and orphans
+	heights   map[string]int // main chain block hash -> height
+	txIndex   map[string]txLocation
+	store     BlockStore     // nil keeps the chain in memory only
+	snapshots *SnapshotStore // nil disables UTXO snapshots
 }
 
 func NewBlockchain(initialUTXOs []UTXO) *Blockchain {
 	bc := &Blockchain{
 		Blocks:  []*Block{},
 		UTXOSet: NewUTXOSet(),
+		index:   NewBlockIndex(),
+		heights: make(map[string]int),
+		txIndex: make(map[string]txLocation),
 	}
 
 	for _, utxo := range initialUTXOs {
 		bc.UTXOSet.AddUTXO(utxo)
 	}
 
-	genesisBlock, err := NewBlock("", 0, bc.GetDifficulty(0), []Transaction{})
+	genesisBlock := GenesisBlock()
+	bc.Blocks = append(bc.Blocks, genesisBlock)
+	bc.index.AddNode(genesisBlock, nil, BlockMainChain)
+	bc.indexBlock(genesisBlock)
+	return bc
+}
+
+// OpenBlockchain loads the chain persisted in store and rebuilds the UTXO set.
+// The newest valid snapshot in snapshots (which may be nil) is used as the
+// starting point, so only the blocks after it are replayed; without one every
+// stored block is replayed on top of the initial UTXOs. An empty store is
+// initialised with a fresh genesis block.
+func OpenBlockchain(initialUTXOs []UTXO, store BlockStore, snapshots *SnapshotStore) (*Blockchain, error) {
+	blocks, err := store.Load()
 	if err != nil {
-		panic(fmt.Sprintf("failed to create genesis block: %v", err))
+		return nil, fmt.Errorf("failed to load blocks: %v", err)
 	}
 
-	bc.Blocks = append(bc.Blocks, genesisBlock)
-	return bc
+	if len(blocks) == 0 {
+		bc := NewBlockchain(initialUTXOs)
+		if err := store.Append(bc.Blocks[0]); err != nil {
+			return nil, fmt.Errorf("failed to persist genesis block: %v", err)
+		}
+		bc.store = store
+		bc.snapshots = snapshots
+		return bc, nil
+	}
+
+	if blocks[0].Hash != GenesisBlock().Hash {
+		return nil, fmt.Errorf("%w: stored chain starts with %s", ErrBadGenesis, blocks[0].Hash)
+	}
+
+	bc := &Blockchain{
+		Blocks:    blocks,
+		index:     NewBlockIndex(),
+		heights:   make(map[string]int),
+		txIndex:   make(map[string]txLocation),
+		store:     store,
+		snapshots: snapshots,
+	}
+
+	var parent *BlockNode
+	for _, block := range blocks {
+		parent = bc.index.AddNode(block, parent, BlockMainChain)
+		bc.indexBlock(block)
+	}
+
+	// The genesis block carries no transactions and is never mined, skip it
+	replayFrom := 1
+	var snapshot *UTXOSnapshot
+	if snapshots != nil {
+		snapshot = snapshots.LatestValid(blocks)
+	}
+	if snapshot != nil {
+		bc.UTXOSet = snapshot.UTXOSet()
+		replayFrom = snapshot.Height + 1
+		logger.InfoLogger.Printf("Loaded UTXO snapshot at height %d", snapshot.Height)
+	} else {
+		bc.UTXOSet = NewUTXOSet()
+		for _, utxo := range initialUTXOs {
+			bc.UTXOSet.AddUTXO(utxo)
+		}
+	}
+
+	for _, block := range blocks[replayFrom:] {
+		if err := bc.UTXOSet.AddBlock(block); err != nil {
+			return nil, fmt.Errorf("failed to replay block %d: %v", block.Header.Height, err)
+		}
+	}
+
+	logger.InfoLogger.Printf("Loaded %d blocks from store (replayed %d), tip: %s", len(blocks), len(blocks)-replayFrom, bc.GetLastBlock().Hash)
+	return bc, nil
+}
+
+// SaveSnapshot writes a snapshot of the UTXO set at the current tip and prunes
+// old snapshots.
+func (bc *Blockchain) SaveSnapshot() (*UTXOSnapshot, error) {
+	if bc.snapshots == nil {
+		return nil, fmt.Errorf("snapshots are not enabled")
+	}
+
+	tip := bc.GetLastBlock()
+	snapshot := NewUTXOSnapshot(tip.Header.Height, tip.Hash, bc.UTXOSet)
+	if err := bc.snapshots.Save(snapshot); err != nil {
+		return nil, err
+	}
+	if err := bc.snapshots.Prune(snapshotsKept); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
 }
 
 const (
 	targetBlockTime  = 20 // seconds
 	difficultyWindow = 10 // blocks
 	dynamicStart     = 1000
+
+	initialDifficulty = "fffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
 )
 
 func (bc *Blockchain) GetDifficulty(cur int) string {
-	// Return initial difficulty for first difficultyWindow blocks
+	// Return initial difficulty for the first dynamicStart blocks
+	if cur <= dynamicStart {
+		return initialDifficulty
+	}
+	return nextDifficulty(bc.index.Lookup(bc.Blocks[cur-1].Hash))
+}
+
+// nextDifficulty computes the difficulty required of a child of parent from the
+// timestamps and difficulties of parent's ancestors, so it works for side
+// branches as well as the main chain.
+func nextDifficulty(parent *BlockNode) string {
+	cur := parent.Header.Height + 1
 	if cur <= dynamicStart {
-		return "fffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+		return initialDifficulty
 	}
 
 	// Get last difficultyWindow blocks
@@ -50,27 +161,30 @@ func (bc *Blockchain) GetDifficulty(cur int) string {
 	}
 
 	// Calculate total time and sum of inverse difficulties
-	totalTime := bc.Blocks[cur-1].Header.Timestamp - bc.Blocks[start-1].Header.Timestamp
+	first := parent
 	totalDifficulty := new(big.Rat)
-
-	for i := start; i < cur; i++ {
-		if i == 0 {
-			continue // skip genesis block
+	for node := parent; node != nil && node.Header.Height >= start-1; node = node.Parent {
+		first = node
+		if node.Header.Height < start {
+			break
 		}
 
 		// Sum inverse difficulties
 		blockDiff := new(big.Int)
-		blockDiff.SetString(bc.Blocks[i].Header.Difficulty, 16)
+		blockDiff.SetString(node.Header.Difficulty, 16)
 		if blockDiff.Sign() == 0 {
 			continue // skip zero difficulty blocks
 		}
 		invDiff := new(big.Rat).SetFrac(big.NewInt(1), blockDiff)
 		totalDifficulty.Add(totalDifficulty, invDiff)
 	}
+	totalTime := parent.Header.Timestamp - first.Header.Timestamp
 
-	// Convert totalTime to seconds
+	// Convert totalTime to seconds, at least one to avoid dividing by zero
 	totalTimeSec := new(big.Rat).SetInt64(totalTime / 1000)
-
+	if totalTime < 1000 {
+		totalTimeSec.SetInt64(1)
+	}
 	// Calculate difficulty ratio: totalDifficulty / totalTimeSec
 	ratio := new(big.Rat).Quo(totalDifficulty, totalTimeSec)
 
@@ -90,6 +204,24 @@ func (bc *Blockchain) GetDifficulty(cur int) string {
 	return newDiffStr
 }
 
+// ChainWork returns the cumulative work of the main chain up to its tip.
+func (bc *Blockchain) ChainWork() *big.Int {
+	return bc.ChainWorkAt(len(bc.Blocks) - 1)
+}
+
+// ChainWorkAt returns the cumulative work of the main chain up to height.
+func (bc *Blockchain) ChainWorkAt(height int) *big.Int {
+	block := bc.GetBlockByHeight(height)
+	if block == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(bc.index.Lookup(block.Hash).ChainWork)
+}
+
+func (bc *Blockchain) tipNode() *BlockNode {
+	return bc.index.Lookup(bc.GetLastBlock().Hash)
+}
+
 func (bc *Blockchain) GetLastBlock() *Block {
 	if len(bc.Blocks) == 0 {
 		return nil
@@ -98,80 +230,110 @@ func (bc *Blockchain) GetLastBlock() *Block {
 }
 
 func (bc *Blockchain) Verify() bool {
-	previousHash := ""
+	var parent *BlockNode
 	for i, block := range bc.Blocks {
-		if block.Header.Height != i {
-			return false
-		}
-
-		if block.Header.PreviousHash != previousHash {
-			return false
-		}
-		previousHash = block.Hash
-
-		if block.Header.Difficulty != bc.GetDifficulty(i) {
+		if err := checkBlockHeader(block, parent); err != nil {
 			return false
 		}
 
-		if !block.Verify() {
+		// The genesis block is never mined
+		if i > 0 && !block.Verify() {
 			return false
 		}
 
+		parent = bc.index.Lookup(block.Hash)
 	}
 	return true
 }
 
-func (bc *Blockchain) ValidateBlocks(blocks []*Block) error {
-	previousHash := ""
-	if len(bc.Blocks) > 0 {
-		previousHash = bc.Blocks[len(bc.Blocks)-1].Hash
-	}
-
-	for i, block := range blocks {
-		if !block.Verify() {
-			return fmt.Errorf("block verification failed for block at index %d", i)
-		}
+func (bc *Blockchain) HasTransaction(txHash string) bool {
+	_, exists := bc.txIndex[txHash]
+	return exists
+}
 
-		if i > 0 && block.Header.PreviousHash != previousHash {
-			return fmt.Errorf("previous hash mismatch at block index %d", i)
-		}
+func (bc *Blockchain) GetTransactionDepth(txHash string) int {
+	location, exists := bc.txIndex[txHash]
+	if !exists {
+		return -1
+	}
+	return len(bc.Blocks) - bc.heights[location.blockHash]
+}
 
-		previousHash = block.Hash
+// GetTransaction returns a main chain transaction with the block containing it.
+func (bc *Blockchain) GetTransaction(txHash string) (*Transaction, *Block) {
+	location, exists := bc.txIndex[txHash]
+	if !exists {
+		return nil, nil
 	}
+	block := bc.Blocks[bc.heights[location.blockHash]]
+	return &block.Content.Transactions[location.index], block
+}
 
-	return nil
+// GetMerkleProof returns a proof that a main chain transaction is part of its
+// block, with the block containing it.
+func (bc *Blockchain) GetMerkleProof(txHash string) (*MerkleProof, *Block, error) {
+	location, exists := bc.txIndex[txHash]
+	if !exists {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTxNotFound, txHash)
+	}
+	block := bc.Blocks[bc.heights[location.blockHash]]
+	if block.Header.Version == LegacyEncoding {
+		return nil, block, fmt.Errorf("block %s predates Merkle content hashes", block.Hash)
+	}
+	proof, err := NewMerkleProof(block.TransactionHashes(), location.index)
+	return proof, block, err
 }
 
-func (bc *Blockchain) HasTransaction(txHash string) bool {
-	for _, block := range bc.Blocks {
-		for _, tx := range block.Content.Transactions {
-			if tx.Hash == txHash {
-				return true
-			}
-		}
+// indexBlock records a block that was appended to the main chain in the hash
+// lookups; unindexBlock removes it again when the block is disconnected.
+func (bc *Blockchain) indexBlock(block *Block) {
+	bc.heights[block.Hash] = block.Header.Height
+	for i, tx := range block.Content.Transactions {
+		bc.txIndex[tx.Hash] = txLocation{blockHash: block.Hash, index: i}
 	}
-	return false
 }
 
-func (bc *Blockchain) GetTransactionDepth(txHash string) int {
-	for i := len(bc.Blocks) - 1; i >= 0; i-- {
-		block := bc.Blocks[i]
-		for _, tx := range block.Content.Transactions {
-			if tx.Hash == txHash {
-				return len(bc.Blocks) - i
-			}
+func (bc *Blockchain) unindexBlock(block *Block) {
+	delete(bc.heights, block.Hash)
+	for _, tx := range block.Content.Transactions {
+		if bc.txIndex[tx.Hash].blockHash == block.Hash {
+			delete(bc.txIndex, tx.Hash)
 		}
 	}
-	return -1
 }
 
-func (bc *Blockchain) CreateBlock(transactions []Transaction) (*Block, error) {
+// CreateBlock builds the next block with the given transactions, preceded by a
+// coinbase paying the subsidy and their fees to rewardAddress.
+func (bc *Blockchain) CreateBlock(rewardAddress string, transactions []Transaction) (*Block, error) {
 	previousHash := ""
 	if len(bc.Blocks) != 0 {
 		previousHash = bc.Blocks[len(bc.Blocks)-1].Hash
 	}
 	height := len(bc.Blocks)
-	return NewBlock(previousHash, height, bc.GetDifficulty(height), transactions)
+
+	reward := BlockSubsidy(height)
+	for _, tx := range transactions {
+		reward += tx.Fee()
+	}
+	coinbase, err := NewCoinbaseTransaction(rewardAddress, height, reward)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := NewBlock(previousHash, height, bc.GetDifficulty(height), append([]Transaction{*coinbase}, transactions...))
+	if err != nil {
+		return nil, err
+	}
+
+	// A node still creating legacy blocks follows a chain that has switched to
+	// the canonical encoding, as block versions cannot decrease.
+	if len(bc.Blocks) != 0 && bc.Blocks[len(bc.Blocks)-1].Header.Version > block.Header.Version {
+		block.Header.Version = bc.Blocks[len(bc.Blocks)-1].Header.Version
+		if block.Header.ContentHash, err = block.CalculateContentHash(); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
 }
 
 func (bc *Blockchain) GetBlockByHeight(height int) *Block {
@@ -181,28 +343,53 @@ func (bc *Blockchain) GetBlockByHeight(height int) *Block {
 	return bc.Blocks[height]
 }
 
+// GetKnownBlock returns a valid block with the given hash from the main chain
+// or any side branch.
+func (bc *Blockchain) GetKnownBlock(hash string) *Block {
+	node := bc.index.Lookup(hash)
+	if node == nil || node.Status == BlockInvalid {
+		return nil
+	}
+	return node.Block
+}
+
 func (bc *Blockchain) GetBlockByHash(hash string) *Block {
-	for _, block := range bc.Blocks {
-		if block.Hash == hash {
-			return block
+	height, exists := bc.heights[hash]
+	if !exists {
+		return nil
+	}
+	return bc.Blocks[height]
+}
+
+func (bc *Blockchain) AddBlock(block *Block) error {
+	if err := bc.connectBlock(block); err != nil {
+		return err
+	}
+
+	if bc.store != nil {
+		if err := bc.store.Append(block); err != nil {
+			bc.disconnectBlock()
+			return fmt.Errorf("failed to persist block: %v", err)
 		}
 	}
+
+	bc.blockConnected(block)
 	return nil
 }
 
-func (bc *Blockchain) AddBlock(block *Block) error {
+// connectBlock validates block against the current tip and applies it to the
+// in-memory chain and UTXO set. It does not touch the block store.
+func (bc *Blockchain) connectBlock(block *Block) error {
+	if block == nil {
+		return fmt.Errorf("missing block")
+	}
+
 	if !block.Verify() {
 		return fmt.Errorf("block verification failed")
 	}
 
-	if len(bc.Blocks) != 0 {
-		previousBlock := bc.Blocks[len(bc.Blocks)-1]
-		if block.Header.PreviousHash != previousBlock.Hash {
-			return fmt.Errorf("previous hash mismatch")
-		}
-		if block.Header.Height != previousBlock.Header.Height+1 {
-			return fmt.Errorf("height mismatch")
-		}
+	if err := checkBlockHeader(block, bc.tipNode()); err != nil {
+		return err
 	}
 
 	err := bc.UTXOSet.AddBlock(block)
@@ -210,7 +397,44 @@ func (bc *Blockchain) AddBlock(block *Block) error {
 		return err
 	}
 
+	node := bc.index.Lookup(block.Hash)
+	if node == nil {
+		node = bc.index.AddNode(block, bc.tipNode(), BlockMainChain)
+	}
+	node.Status = BlockMainChain
+
 	bc.Blocks = append(bc.Blocks, block)
+	bc.indexBlock(block)
+	return nil
+}
+
+// disconnectBlock removes the tip from the in-memory chain and undoes its
+// effect on the UTXO set. It does not touch the block store.
+func (bc *Blockchain) disconnectBlock() (*Block, error) {
+	if len(bc.Blocks) <= 1 {
+		return nil, fmt.Errorf("cannot disconnect the genesis block")
+	}
+
+	tip := bc.Blocks[len(bc.Blocks)-1]
+	if err := bc.UTXOSet.RemoveBlock(tip); err != nil {
+		return nil, fmt.Errorf("failed to undo block %s: %v", tip.Hash, err)
+	}
+
+	bc.index.Lookup(tip.Hash).Status = BlockSideChain
+	bc.Blocks = bc.Blocks[:len(bc.Blocks)-1]
+	bc.unindexBlock(tip)
+	return tip, nil
+}
+
+// blockConnected runs the bookkeeping that follows a durably connected block.
+// A snapshot captures the UTXO set at the tip, so it is only taken when block
+// is the tip, not for the blocks a reorganization connected below it.
+func (bc *Blockchain) blockConnected(block *Block) {
+	if bc.snapshots != nil && block.Header.Height%snapshotInterval == 0 && block.Hash == bc.GetLastBlock().Hash {
+		if _, err := bc.SaveSnapshot(); err != nil {
+			logger.ErrorLogger.Printf("Failed to save UTXO snapshot at height %d: %v", block.Header.Height, err)
+		}
+	}
 
 	if block.Header.Height%10 == 0 {
 		var hashes []string
@@ -219,8 +443,6 @@ func (bc *Blockchain) AddBlock(block *Block) error {
 		}
 		logger.InfoLogger.Printf("Blockchain hashes at height %d: %s", block.Header.Height, strings.Join(hashes, ", "))
 	}
-
-	return nil
 }
 
 // func (bc *Blockchain) Fork(hash string) *Blockchain {
@@ -241,28 +463,53 @@ func (bc *Blockchain) AddBlock(block *Block) error {
 // 	return newChain
 // }
 
+// RollbackToHash disconnects blocks from the tip until toHash is the tip,
+// restoring the UTXOs they spent. The removed blocks are returned tip first so
+// the caller can hand their transactions back to the mempool.
 func (bc *Blockchain) RollbackToHash(toHash string) ([]*Block, error) {
-	removedBlocks := []*Block{}
+	removedBlocks, err := bc.rewindTo(toHash)
+	if err != nil {
+		return nil, err
+	}
 
-	for len(bc.Blocks) > 0 {
-		lastBlock := bc.Blocks[len(bc.Blocks)-1]
-		if lastBlock.Hash == toHash {
-			break
+	if bc.store != nil {
+		if err := bc.store.Truncate(bc.GetLastBlock().Header.Height); err != nil {
+			return nil, fmt.Errorf("failed to truncate block store: %v", err)
 		}
-
-		removedBlocks = append(removedBlocks, lastBlock)
-		bc.Blocks = bc.Blocks[:len(bc.Blocks)-1]
 	}
 
-	if len(bc.Blocks) == 0 || bc.Blocks[len(bc.Blocks)-1].Hash != toHash {
+	return removedBlocks, nil
+}
+
+// rewindTo disconnects blocks in memory until toHash is the tip. If a block
+// cannot be undone, the blocks already disconnected are reconnected.
+func (bc *Blockchain) rewindTo(toHash string) ([]*Block, error) {
+	if bc.GetBlockByHash(toHash) == nil {
 		return nil, fmt.Errorf("ancestor block with hash %s not found", toHash)
 	}
 
-	// return removed transactions back to mempool
-
+	removedBlocks := []*Block{}
+	for bc.GetLastBlock().Hash != toHash {
+		block, err := bc.disconnectBlock()
+		if err != nil {
+			bc.reconnect(removedBlocks)
+			return nil, err
+		}
+		removedBlocks = append(removedBlocks, block)
+	}
 	return removedBlocks, nil
 }
 
+// reconnect re-applies blocks removed by rewindTo (given tip first). They were
+// valid on top of the current tip before, so failure means corrupted state.
+func (bc *Blockchain) reconnect(removedBlocks []*Block) {
+	for i := len(removedBlocks) - 1; i >= 0; i-- {
+		if err := bc.connectBlock(removedBlocks[i]); err != nil {
+			panic(fmt.Sprintf("failed to restore block %s: %v", removedBlocks[i].Hash, err))
+		}
+	}
+}
+
 // Dealing With Forks
 /*
 When we receive a new block from a peer, we need to check if it is part of the main chain or a fork.
@@ -276,140 +523,262 @@ There are a couple of scenarios to consider:
 	Resolved Orphans						Add to chain, process dependent orphans recursively.
 	Fork with Higher PoW					Rollback main chain, apply fork blocks.
 
-Potential Improvement:
-	1) Validate the block
-	2) Check if the block extends the main chain; add to chain. Break.
-	3) Create a new fork if block extends main chain.
-	4) Check if the block extends a known fork; add to fork. Validate fork.
-		a) If the fork is longer, switch to fork.
-		b) If the block is a fork of a fork, add as a new fork with reference to parent.
-	5) Check if the block references an unknown parent; add to orphan pool.
-
-	6) If added to chain, process orphans.
-
 Current Approach:
-	1) Receive a new block (which contains the last 100 block head)
-	2) Check if the block extends the main chain
-	3) If block is longer, and dynamically ask for the missing blocks and update main if longer
+	Every valid block is kept in the block index with its parent and cumulative work, whether it is on the
+	main chain or a side branch. Blocks with an unknown parent are buffered in the orphan pool and the
+	caller syncs the missing ancestors from its peers, locating the fork point with a block locator. Once a
+	block is indexed, the main chain switches to it if it has more work than the current tip, and any
+	orphans waiting on it are processed in turn.
 */
 
-/*
-	I still to do the following:
-		1) Validate the incoming chain
-*/
+// Reorg describes how the main chain changed. Removed is empty when the chain
+// was only extended.
+type Reorg struct {
+	Removed []*Block // stale main chain blocks, tip first
+	Added   []*Block // blocks now on the main chain, in height order
+}
 
-func (bc *Blockchain) GetLast100Hashes() []string {
-	hashes := []string{}
-	start := 0
+var (
+	ErrDuplicateBlock = errors.New("block already known")
+	ErrOrphanBlock    = errors.New("block parent is unknown")
+)
 
-	if len(bc.Blocks) > 100 {
-		start = len(bc.Blocks) - 100
+// ProcessBlock indexes a block received from a peer and updates the main chain
+// to the valid chain with the most work. A block whose parent is unknown is
+// kept in the orphan pool and ErrOrphanBlock is returned; MissingAncestor then
+// tells which block to request. The returned Reorg is nil when the main chain
+// did not change.
+func (bc *Blockchain) ProcessBlock(block *Block) (*Reorg, error) {
+	return bc.processBlock(block, true)
+}
+
+// ProcessVerifiedBlock is ProcessBlock for a block the caller already checked
+// with Verify, which is costly enough not to run twice.
+func (bc *Blockchain) ProcessVerifiedBlock(block *Block) (*Reorg, error) {
+	return bc.processBlock(block, false)
+}
+
+func (bc *Blockchain) processBlock(block *Block, verify bool) (*Reorg, error) {
+	if block == nil {
+		return nil, fmt.Errorf("missing block")
 	}
 
-	for i := start; i < len(bc.Blocks); i++ {
-		hashes = append(hashes, bc.Blocks[i].Hash)
+	if bc.index.Lookup(block.Hash) != nil || bc.index.HasOrphan(block.Hash) {
+		return nil, ErrDuplicateBlock
 	}
 
-	return hashes
-}
+	if verify && !block.Verify() {
+		return nil, fmt.Errorf("block verification failed")
+	}
 
-// ? Here we are passing requestBlock down, alternatively we can lift the handle fork function to the blockchain node level
-func (bc *Blockchain) HandleFork(incomingHashes []string, requestBlock func(hash string) *Block) error {
-	logger.DebugLogger.Println("[HandleFork] Handling fork...")
+	// Only our own genesis block may have height 0, and it is already indexed
+	if block.Header.Height == 0 {
+		return nil, checkBlockHeader(block, nil)
+	}
+
+	if bc.index.Lookup(block.Header.PreviousHash) == nil {
+		bc.index.AddOrphan(block)
+		logger.DebugLogger.Printf("[ProcessBlock] Orphan block %s, missing ancestor %s", block.Hash, bc.index.MissingAncestor(block.Hash))
+		return nil, ErrOrphanBlock
+	}
 
-	ancestor := bc.FindCommonAncestor(incomingHashes)
-	if ancestor == nil {
-		logger.ErrorLogger.Println("[HandleFork] Common ancestor not found for incoming hashes.")
-		return fmt.Errorf("common ancestor not found for block")
+	oldTip := bc.tipNode()
+	if err := bc.acceptBlock(block); err != nil {
+		return nil, err
+	}
+
+	// Connect the orphans that were waiting on this block, recursively
+	queue := []string{block.Hash}
+	for len(queue) > 0 {
+		parentHash := queue[0]
+		queue = queue[1:]
+		for _, orphan := range bc.index.TakeOrphanChildren(parentHash) {
+			if err := bc.acceptBlock(orphan); err != nil {
+				logger.WarnLogger.Printf("[ProcessBlock] Rejected orphan block %s: %v", orphan.Hash, err)
+				continue
+			}
+			queue = append(queue, orphan.Hash)
+		}
 	}
-	logger.DebugLogger.Printf("[HandleFork] Found common ancestor: %s", ancestor.Hash)
 
-	mainChainWork := bc.ComputeWork(bc.GetLast100Hashes(), ancestor.Hash)
-	forkChainWork := bc.ComputeWork(incomingHashes, ancestor.Hash)
+	return bc.chainUpdate(oldTip), nil
+}
 
-	logger.DebugLogger.Printf("[HandleFork] Main chain work: %d, Fork chain work: %d", mainChainWork, forkChainWork)
+// HasBlock reports whether the block is known, valid or not, including orphans.
+func (bc *Blockchain) HasBlock(hash string) bool {
+	return bc.index.Lookup(hash) != nil || bc.index.HasOrphan(hash)
+}
 
-	if forkChainWork > mainChainWork {
-		logger.InfoLogger.Println("[HandleFork] Fork chain has more work. Handling fork replacement...")
+// MissingAncestor returns the hash of the block needed to connect the orphan
+// with the given hash, or "" if it is not an orphan.
+func (bc *Blockchain) MissingAncestor(hash string) string {
+	return bc.index.MissingAncestor(hash)
+}
 
-		// ? Here we are passing requestBlock down, alternatively we can lift the handle fork function to the blockchain node level
-		missingBlocks := bc.RequestMissingBlocks(incomingHashes, ancestor.Hash, requestBlock)
-		logger.InfoLogger.Printf("[HandleFork] Retrieved %d missing blocks from fork.", len(missingBlocks))
+// acceptBlock indexes a verified block whose parent is indexed, connecting it
+// to the main chain directly or through a reorganization when it leads to the
+// chain with the most work.
+func (bc *Blockchain) acceptBlock(block *Block) error {
+	parent := bc.index.Lookup(block.Header.PreviousHash)
+	if parent.Status == BlockInvalid {
+		bc.index.AddNode(block, parent, BlockInvalid)
+		return fmt.Errorf("block extends an invalid block")
+	}
 
-		if err := bc.ValidateBlocks(missingBlocks); err != nil {
-			logger.InfoLogger.Printf("[HandleFork] Validation failed for blocks in fork: %v", err)
-			return fmt.Errorf("invalid blocks in fork: %v", err)
-		}
-		logger.InfoLogger.Println("[HandleFork] Fork blocks validated successfully.")
+	if err := checkBlockHeader(block, parent); err != nil {
+		return err
+	}
 
-		if err := bc.ReplaceWithFork(missingBlocks); err != nil {
-			logger.ErrorLogger.Printf("[HandleFork] Failed to replace main chain with fork: %v", err)
-			return fmt.Errorf("failed to replace chain with fork: %v", err)
+	tip := bc.tipNode()
+	if parent == tip {
+		if err := bc.connectBlock(block); err != nil {
+			bc.index.AddNode(block, parent, BlockInvalid)
+			return err
 		}
-		logger.InfoLogger.Println("[HandleFork] Successfully replaced main chain with fork.")
-		// Print last 100 hashes
-		logger.InfoLogger.Printf("[HandleFork] Last 100 hashes: %v", bc.GetLast100Hashes())
-	} else {
-		logger.DebugLogger.Println("[HandleFork] Main chain has more work. No changes applied.")
+		if bc.store != nil {
+			if err := bc.store.Append(block); err != nil {
+				bc.disconnectBlock()
+				bc.index.RemoveNode(block.Hash)
+				return fmt.Errorf("failed to persist block: %v", err)
+			}
+		}
+		bc.blockConnected(block)
+		return nil
 	}
 
-	return nil
+	node := bc.index.AddNode(block, parent, BlockSideChain)
+	if node.ChainWork.Cmp(tip.ChainWork) <= 0 {
+		logger.DebugLogger.Printf("[ProcessBlock] Block %s stored on a side branch at height %d", block.Hash, block.Header.Height)
+		return nil
+	}
+
+	logger.InfoLogger.Printf("[ProcessBlock] Side branch ending at %s has more work (%s > %s), reorganizing", block.Hash, node.ChainWork, tip.ChainWork)
+	return bc.activateBranch(node)
 }
 
-func (bc *Blockchain) FindCommonAncestor(incomingHashes []string) *Block {
-	bcHashToHeight := make(map[string]int)
-	for i, block := range bc.Blocks {
-		bcHashToHeight[block.Hash] = i
+// activateBranch reorganizes the main chain so that node becomes the tip. The
+// block that fails validation, if any, is marked invalid with its descendants.
+func (bc *Blockchain) activateBranch(node *BlockNode) error {
+	fork := FindFork(bc.tipNode(), node)
+	if fork == nil {
+		return fmt.Errorf("branch does not share an ancestor with the main chain")
 	}
 
-	var best *Block
-	bestHeight := -1
+	var forkBlocks []*Block
+	for n := node; n != fork; n = n.Parent {
+		forkBlocks = append([]*Block{n.Block}, forkBlocks...)
+	}
 
-	for _, hash := range incomingHashes {
-		if h, exists := bcHashToHeight[hash]; exists && h > bestHeight {
-			bestHeight = h
-			best = bc.Blocks[h]
+	if _, failed, err := bc.replaceWithFork(forkBlocks); err != nil {
+		if failed >= 0 {
+			bc.index.MarkInvalid(bc.index.Lookup(forkBlocks[failed].Hash))
 		}
+		return err
 	}
-	return best
-}
 
-// Does not work in dynamic difficulty
-func (bc *Blockchain) ComputeWork(hashes []string, endHash string) int {
-	return len(hashes)
+	logger.InfoLogger.Printf("[ProcessBlock] Reorganized onto %s at height %d", node.Hash, node.Header.Height)
+	return nil
 }
 
-// ? Here we are passing requestBlock down, alternatively we can lift the handle fork function to the blockchain node level
-func (bc *Blockchain) RequestMissingBlocks(incomingHashes []string, startHash string, requestBlock func(hash string) *Block) []*Block {
-	missingBlocksReversed := []*Block{}
-	for i := len(incomingHashes) - 1; i >= 0; i-- {
-		if incomingHashes[i] == startHash {
-			break
-		}
-		missingBlocksReversed = append(missingBlocksReversed, requestBlock(incomingHashes[i]))
+// chainUpdate describes how the main chain moved since oldTip was its tip.
+func (bc *Blockchain) chainUpdate(oldTip *BlockNode) *Reorg {
+	newTip := bc.tipNode()
+	if newTip == oldTip {
+		return nil
+	}
+
+	fork := FindFork(oldTip, newTip)
+	reorg := &Reorg{}
+	for n := oldTip; n != fork; n = n.Parent {
+		reorg.Removed = append(reorg.Removed, n.Block)
 	}
-	missingBlocks := []*Block{}
-	for i := 0; i < len(missingBlocksReversed); i++ {
-		missingBlocks = append(missingBlocks, missingBlocksReversed[len(missingBlocksReversed)-i-1])
+	for n := newTip; n != fork; n = n.Parent {
+		reorg.Added = append([]*Block{n.Block}, reorg.Added...)
 	}
-	return missingBlocks
+	return reorg
+}
+
+// ReplaceWithFork atomically reorganizes the chain onto forkBlocks, which must
+// start right after a block of the main chain and be ordered by height. The
+// stale main chain blocks are undone from the UTXO set and every fork block is
+// fully validated as it is applied. If any fork block fails, the original chain
+// and UTXO set are restored. The stale blocks are returned tip first.
+func (bc *Blockchain) ReplaceWithFork(missingBlocks []*Block) ([]*Block, error) {
+	removedBlocks, _, err := bc.replaceWithFork(missingBlocks)
+	return removedBlocks, err
 }
 
-func (bc *Blockchain) ReplaceWithFork(missingBlocks []*Block) error {
+// replaceWithFork implements ReplaceWithFork, additionally reporting the index
+// of the fork block that failed validation, or -1 if the failure was not
+// caused by a fork block.
+func (bc *Blockchain) replaceWithFork(missingBlocks []*Block) ([]*Block, int, error) {
 	if len(missingBlocks) == 0 {
-		return fmt.Errorf("no blocks to replace with")
+		return nil, -1, fmt.Errorf("no blocks to replace with")
+	}
+	if missingBlocks[0] == nil {
+		return nil, 0, fmt.Errorf("missing fork block")
 	}
 
 	ancestorHash := missingBlocks[0].Header.PreviousHash
 
-	_, err := bc.RollbackToHash(ancestorHash)
+	removedBlocks, err := bc.rewindTo(ancestorHash)
 	if err != nil {
-		return fmt.Errorf("failed to rollback to ancestor: %v", err)
+		return nil, -1, fmt.Errorf("failed to rollback to ancestor: %v", err)
+	}
+
+	for i, block := range missingBlocks {
+		if err := bc.connectBlock(block); err != nil {
+			logger.WarnLogger.Printf("[ReplaceWithFork] Fork block %d rejected, restoring original chain: %v", i, err)
+			for j := 0; j < i; j++ {
+				if _, undoErr := bc.disconnectBlock(); undoErr != nil {
+					panic(fmt.Sprintf("failed to undo fork block: %v", undoErr))
+				}
+			}
+			bc.reconnect(removedBlocks)
+			return nil, i, fmt.Errorf("invalid fork block at index %d: %v", i, err)
+		}
+	}
+
+	if bc.store != nil {
+		if err := bc.persistFork(removedBlocks, missingBlocks); err != nil {
+			return nil, -1, err
+		}
 	}
 
 	for _, block := range missingBlocks {
-		bc.Blocks = append(bc.Blocks, block)
+		bc.blockConnected(block)
 	}
 
-	return nil
+	return removedBlocks, -1, nil
+}
+
+// persistFork writes a completed reorganization to the block store. On failure
+// the in-memory chain and the store are both put back to the original chain.
+func (bc *Blockchain) persistFork(removedBlocks, forkBlocks []*Block) error {
+	ancestorHeight := forkBlocks[0].Header.Height - 1
+
+	err := bc.store.Truncate(ancestorHeight)
+	for i := 0; err == nil && i < len(forkBlocks); i++ {
+		err = bc.store.Append(forkBlocks[i])
+	}
+	if err == nil {
+		return nil
+	}
+
+	for range forkBlocks {
+		if _, undoErr := bc.disconnectBlock(); undoErr != nil {
+			panic(fmt.Sprintf("failed to undo fork block: %v", undoErr))
+		}
+	}
+	bc.reconnect(removedBlocks)
+
+	restoreErr := bc.store.Truncate(ancestorHeight)
+	for i := len(removedBlocks) - 1; restoreErr == nil && i >= 0; i-- {
+		restoreErr = bc.store.Append(removedBlocks[i])
+	}
+	if restoreErr != nil {
+		logger.ErrorLogger.Printf("[ReplaceWithFork] Failed to restore block store: %v", restoreErr)
+	}
+
+	return fmt.Errorf("failed to persist fork: %v", err)
 }
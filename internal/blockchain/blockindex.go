@@ -0,0 +1,197 @@
+package blockchain
+
+import (
+	"math/big"
+)
+
+type BlockStatus int
+
+const (
+	BlockSideChain BlockStatus = iota // valid block that is not on the main chain
+	BlockMainChain                    // block on the main chain
+	BlockInvalid                      // block or one of its ancestors failed validation
+)
+
+const maxOrphanBlocks = 100
+
+// BlockNode is the index entry of a block whose ancestry is known.
+type BlockNode struct {
+	Hash      string
+	Header    BlockHeader
+	Parent    *BlockNode
+	ChainWork *big.Int // cumulative work of the chain ending at this block
+	Status    BlockStatus
+	Block     *Block // kept so the chain can be reorganized onto side branches
+}
+
+// BlockIndex tracks every block we know of: the main chain, side branches and
+// orphans, which are blocks whose parent has not been seen yet.
+type BlockIndex struct {
+	nodes           map[string]*BlockNode
+	children        map[string][]*BlockNode // indexed children by parent hash
+	orphans         map[string]*Block
+	orphansByParent map[string][]*Block
+	orphanOrder     []string // oldest first, used to evict orphans
+}
+
+func NewBlockIndex() *BlockIndex {
+	return &BlockIndex{
+		nodes:           make(map[string]*BlockNode),
+		children:        make(map[string][]*BlockNode),
+		orphans:         make(map[string]*Block),
+		orphansByParent: make(map[string][]*Block),
+	}
+}
+
+func (idx *BlockIndex) Lookup(hash string) *BlockNode {
+	return idx.nodes[hash]
+}
+
+// AddNode indexes block as a child of parent, which is nil only for genesis.
+func (idx *BlockIndex) AddNode(block *Block, parent *BlockNode, status BlockStatus) *BlockNode {
+	work := block.Header.Work()
+	if parent != nil {
+		work.Add(work, parent.ChainWork)
+	}
+
+	node := &BlockNode{
+		Hash:      block.Hash,
+		Header:    block.Header,
+		Parent:    parent,
+		ChainWork: work,
+		Status:    status,
+		Block:     block,
+	}
+	idx.nodes[block.Hash] = node
+	if parent != nil {
+		idx.children[parent.Hash] = append(idx.children[parent.Hash], node)
+	}
+	return node
+}
+
+func (idx *BlockIndex) RemoveNode(hash string) {
+	node, exists := idx.nodes[hash]
+	if !exists {
+		return
+	}
+	delete(idx.nodes, hash)
+	delete(idx.children, hash)
+	if node.Parent == nil {
+		return
+	}
+
+	siblings := idx.children[node.Parent.Hash]
+	for i, sibling := range siblings {
+		if sibling == node {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(idx.children, node.Parent.Hash)
+	} else {
+		idx.children[node.Parent.Hash] = siblings
+	}
+}
+
+// MarkInvalid flags node and every indexed descendant of it as invalid,
+// visiting only the subtree rooted at node.
+func (idx *BlockIndex) MarkInvalid(node *BlockNode) {
+	queue := []*BlockNode{node}
+	for len(queue) > 0 {
+		node, queue = queue[0], queue[1:]
+		node.Status = BlockInvalid
+		queue = append(queue, idx.children[node.Hash]...)
+	}
+}
+
+func (idx *BlockIndex) HasOrphan(hash string) bool {
+	_, exists := idx.orphans[hash]
+	return exists
+}
+
+// AddOrphan buffers a block whose parent is unknown, evicting the oldest orphan
+// once the pool is full.
+func (idx *BlockIndex) AddOrphan(block *Block) {
+	if idx.HasOrphan(block.Hash) {
+		return
+	}
+
+	for len(idx.orphanOrder) >= maxOrphanBlocks {
+		idx.removeOrphan(idx.orphanOrder[0])
+	}
+
+	idx.orphans[block.Hash] = block
+	idx.orphansByParent[block.Header.PreviousHash] = append(idx.orphansByParent[block.Header.PreviousHash], block)
+	idx.orphanOrder = append(idx.orphanOrder, block.Hash)
+}
+
+func (idx *BlockIndex) removeOrphan(hash string) {
+	block, exists := idx.orphans[hash]
+	if !exists {
+		return
+	}
+	delete(idx.orphans, hash)
+
+	siblings := idx.orphansByParent[block.Header.PreviousHash]
+	for i, sibling := range siblings {
+		if sibling.Hash == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(idx.orphansByParent, block.Header.PreviousHash)
+	} else {
+		idx.orphansByParent[block.Header.PreviousHash] = siblings
+	}
+
+	for i, orphanHash := range idx.orphanOrder {
+		if orphanHash == hash {
+			idx.orphanOrder = append(idx.orphanOrder[:i], idx.orphanOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// TakeOrphanChildren removes and returns the orphans waiting for parentHash.
+func (idx *BlockIndex) TakeOrphanChildren(parentHash string) []*Block {
+	children := append([]*Block{}, idx.orphansByParent[parentHash]...)
+	for _, child := range children {
+		idx.removeOrphan(child.Hash)
+	}
+	return children
+}
+
+// MissingAncestor follows the orphan chain starting at hash back to its oldest
+// orphan and returns the hash of that orphan's unknown parent.
+func (idx *BlockIndex) MissingAncestor(hash string) string {
+	block, exists := idx.orphans[hash]
+	if !exists {
+		return ""
+	}
+	for {
+		parent, exists := idx.orphans[block.Header.PreviousHash]
+		if !exists {
+			return block.Header.PreviousHash
+		}
+		block = parent
+	}
+}
+
+// FindFork returns the last common ancestor of two indexed nodes.
+func FindFork(a, b *BlockNode) *BlockNode {
+	for a != nil && b != nil && a != b {
+		if a.Header.Height > b.Header.Height {
+			a = a.Parent
+		} else if b.Header.Height > a.Header.Height {
+			b = b.Parent
+		} else {
+			a, b = a.Parent, b.Parent
+		}
+	}
+	if a != b {
+		return nil
+	}
+	return a
+}
@@ -0,0 +1,82 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestProcessBlockConnectsOrphans(t *testing.T) {
+	bc := NewBlockchain(nil)
+	b1 := mineOn(t, bc, bc.Blocks[0])
+	b2 := mineOn(t, bc, b1)
+	b3 := mineOn(t, bc, b2)
+
+	// The descendants arrive first and wait for their ancestors
+	for _, block := range []*Block{b3, b2} {
+		if _, err := bc.ProcessBlock(block); err != ErrOrphanBlock {
+			t.Fatalf("block %d: got %v, want ErrOrphanBlock", block.Header.Height, err)
+		}
+	}
+	if missing := bc.MissingAncestor(b3.Hash); missing != b1.Hash {
+		t.Fatalf("missing ancestor %s, want %s", missing, b1.Hash)
+	}
+	if _, err := bc.ProcessBlock(b2); err != ErrDuplicateBlock {
+		t.Fatalf("orphan resubmitted: got %v, want ErrDuplicateBlock", err)
+	}
+
+	reorg, err := bc.ProcessBlock(b1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reorg == nil || len(reorg.Added) != 3 {
+		t.Fatalf("unexpected update %+v", reorg)
+	}
+	if bc.GetLastBlock().Hash != b3.Hash || bc.index.HasOrphan(b2.Hash) || bc.index.HasOrphan(b3.Hash) {
+		t.Fatal("orphans not connected")
+	}
+}
+
+func TestOrphanPoolEvictsOldest(t *testing.T) {
+	idx := NewBlockIndex()
+	for i := 0; i <= maxOrphanBlocks; i++ {
+		idx.AddOrphan(&Block{Hash: fmt.Sprint("orphan", i), Header: BlockHeader{PreviousHash: "parent"}})
+	}
+	if idx.HasOrphan("orphan0") || !idx.HasOrphan(fmt.Sprint("orphan", maxOrphanBlocks)) {
+		t.Fatal("oldest orphan not evicted")
+	}
+	if children := idx.TakeOrphanChildren("parent"); len(children) != maxOrphanBlocks {
+		t.Fatalf("%d orphans taken, want %d", len(children), maxOrphanBlocks)
+	}
+	if idx.HasOrphan("orphan1") || len(idx.orphanOrder) != 0 {
+		t.Fatal("taken orphans still pooled")
+	}
+}
+
+func TestMarkInvalidFlagsDescendantsOnly(t *testing.T) {
+	idx := NewBlockIndex()
+	add := func(hash string, parent *BlockNode) *BlockNode {
+		return idx.AddNode(&Block{Hash: hash, Header: BlockHeader{Difficulty: "ff"}}, parent, BlockSideChain)
+	}
+	genesis := add("genesis", nil)
+	a := add("a", genesis)
+	b := add("b", a)
+	c1, c2 := add("c1", b), add("c2", b)
+	side := add("side", genesis)
+	removed := add("removed", a)
+	idx.RemoveNode(removed.Hash)
+
+	idx.MarkInvalid(a)
+	for _, node := range []*BlockNode{a, b, c1, c2} {
+		if node.Status != BlockInvalid {
+			t.Fatalf("descendant %s not marked invalid", node.Hash)
+		}
+	}
+	for _, node := range []*BlockNode{genesis, side, removed} {
+		if node.Status == BlockInvalid {
+			t.Fatalf("%s marked invalid", node.Hash)
+		}
+	}
+	if len(idx.children[a.Hash]) != 1 {
+		t.Fatal("removed node still listed as a child")
+	}
+}
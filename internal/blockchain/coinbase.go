@@ -0,0 +1,104 @@
+package blockchain
+
+import (
+	"math"
+	"nakamoto-blockchain/logger"
+	"time"
+)
+
+// Block reward parameters. All nodes of a network must use the same values.
+var (
+	InitialSubsidy   int64 = 50   // reward of the first blocks, before any halving
+	HalvingInterval        = 1000 // blocks between halvings of the subsidy
+	CoinbaseMaturity       = 10   // confirmations before a coinbase output can be spent
+)
+
+// BlockSubsidy returns the newly created coins a miner may claim at height.
+func BlockSubsidy(height int) int64 {
+	halvings := height / HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return InitialSubsidy >> halvings
+}
+
+// NewCoinbaseTransaction creates the transaction paying the block reward of the
+// block at height to address. The height keeps coinbase hashes unique.
+func NewCoinbaseTransaction(address string, height int, reward int64) (*Transaction, error) {
+	tx := &Transaction{
+		Content: TransactionContent{
+			Version:    EncodingVersion,
+			InputUTXOs: []UTXO{},
+			OutputUTXOs: []UTXO{{
+				Index:   0,
+				Amount:  reward,
+				Address: address,
+			}},
+			Timestamp: time.Now().UnixMilli(),
+			Height:    height,
+		},
+	}
+
+	hash, err := tx.CalculateHash()
+	if err != nil {
+		return nil, err
+	}
+	tx.Hash = hash
+	return tx, nil
+}
+
+// Reward returns the subsidy of b plus the fees of its transactions after the
+// coinbase, or false if one of them has invalid amounts or the sum overflows.
+func (b *Block) Reward() (int64, bool) {
+	reward := BlockSubsidy(b.Header.Height)
+	for _, tx := range b.Content.Transactions[1:] {
+		fee, ok := tx.checkedFee()
+		if !ok || fee > math.MaxInt64-reward {
+			return 0, false
+		}
+		reward += fee
+	}
+	return reward, true
+}
+
+// IsCoinbase reports whether tx creates coins instead of spending UTXOs.
+func (tx *Transaction) IsCoinbase() bool {
+	return len(tx.Content.InputUTXOs) == 0
+}
+
+// VerifyCoinbase checks that tx is a well formed coinbase for the block at
+// height. The reward amount is checked by the block, which knows the fees.
+func (tx *Transaction) VerifyCoinbase(height int) bool {
+	if !tx.IsCoinbase() || tx.Content.SenderPubKey != "" || tx.Signature != "" || len(tx.Witnesses) > 0 {
+		logger.WarnLogger.Println("Coinbase transaction has inputs or a sender")
+		return false
+	}
+
+	if tx.Content.Version < LegacyEncoding || tx.Content.Version > CanonicalEncoding {
+		logger.WarnLogger.Printf("Unknown coinbase transaction version %d", tx.Content.Version)
+		return false
+	}
+
+	if tx.Content.Height != height {
+		logger.WarnLogger.Printf("Coinbase transaction height %d does not match block height %d", tx.Content.Height, height)
+		return false
+	}
+
+	if len(tx.Content.OutputUTXOs) == 0 || len(tx.Content.OutputUTXOs) > MaxTransactionOutputs {
+		logger.WarnLogger.Println("Coinbase transaction has no outputs or too many")
+		return false
+	}
+	for i, utxo := range tx.Content.OutputUTXOs {
+		if utxo.Amount <= 0 || utxo.TxID != "" || utxo.Index != i || utxo.Address == "" || utxo.LockTime < 0 || !utxo.validLockScript() {
+			logger.WarnLogger.Println("Invalid coinbase output UTXO")
+			return false
+		}
+	}
+	if _, ok := sumAmounts(tx.Content.OutputUTXOs); !ok {
+		logger.WarnLogger.Println("Coinbase output amounts overflow")
+		return false
+	}
+
+	hash, err := tx.CalculateHash()
+	return err == nil && hash == tx.Hash
+}
@@ -0,0 +1,141 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// A compact block relays a block as its header and a 6 byte short ID for each
+// transaction, as peers usually have most of them in their pool already. The
+// short IDs are salted with the block hash and a random nonce, so nobody can
+// craft transactions colliding with those of a block in advance. The coinbase
+// is never in a pool and is sent in full, as are the transactions a peer
+// reports missing.
+const shortIDBytes = 6
+
+var ErrBadCompactBlock = errors.New("invalid compact block")
+
+// PrefilledTransaction is a transaction sent in full in a compact block.
+type PrefilledTransaction struct {
+	Index       int // position of the transaction in the block
+	Transaction Transaction
+}
+
+type CompactBlock struct {
+	Header    BlockHeader
+	Hash      string
+	Nonce     uint64
+	ShortIDs  []uint64               // short IDs of the other transactions, in block order
+	Prefilled []PrefilledTransaction // in block order
+}
+
+// NewCompactBlock returns the compact form of block, with the coinbase and the
+// transactions at the given positions sent in full. It fails if no random
+// nonce is available, as predictable short IDs could be collided on purpose.
+func NewCompactBlock(block *Block, prefill []int) (*CompactBlock, error) {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate a short ID nonce: %v", err)
+	}
+	cb := &CompactBlock{
+		Header: block.Header,
+		Hash:   block.Hash,
+		Nonce:  binary.BigEndian.Uint64(nonce[:]),
+	}
+
+	full := map[int]bool{0: true}
+	for _, i := range prefill {
+		full[i] = true
+	}
+	key := cb.shortIDKey()
+	for i, tx := range block.Content.Transactions {
+		if full[i] {
+			cb.Prefilled = append(cb.Prefilled, PrefilledTransaction{Index: i, Transaction: tx})
+		} else {
+			cb.ShortIDs = append(cb.ShortIDs, shortTxID(key, tx.Hash))
+		}
+	}
+	return cb, nil
+}
+
+// TransactionCount returns the number of transactions of the block.
+func (cb *CompactBlock) TransactionCount() int {
+	return len(cb.ShortIDs) + len(cb.Prefilled)
+}
+
+// Reconstruct rebuilds the block from the prefilled transactions and those of
+// pool matching the short IDs. If some transactions are not in the pool, or
+// short IDs collided and the transactions found do not match the content hash,
+// it returns the positions of the transactions to send in full instead.
+func (cb *CompactBlock) Reconstruct(pool *TransactionPool) (*Block, []int, error) {
+	count := cb.TransactionCount()
+	for i, prefilled := range cb.Prefilled {
+		if prefilled.Index < 0 || prefilled.Index >= count || (i > 0 && prefilled.Index <= cb.Prefilled[i-1].Index) {
+			return nil, nil, fmt.Errorf("%w: prefilled transaction at position %d of %d", ErrBadCompactBlock, prefilled.Index, count)
+		}
+	}
+
+	// Pool transactions sharing a short ID cannot be told apart, the peer
+	// has to send them
+	key := cb.shortIDKey()
+	candidates := make(map[uint64]string, len(pool.Transactions))
+	for hash := range pool.Transactions {
+		id := shortTxID(key, hash)
+		if _, exists := candidates[id]; exists {
+			candidates[id] = ""
+		} else {
+			candidates[id] = hash
+		}
+	}
+
+	transactions := make([]Transaction, count)
+	var missing, shortened []int
+	shortIDs, prefilled := cb.ShortIDs, cb.Prefilled
+	for i := range transactions {
+		if len(prefilled) > 0 && prefilled[0].Index == i {
+			transactions[i] = prefilled[0].Transaction
+			prefilled = prefilled[1:]
+			continue
+		}
+		shortened = append(shortened, i)
+		if hash := candidates[shortIDs[0]]; hash != "" {
+			transactions[i] = pool.Transactions[hash]
+		} else {
+			missing = append(missing, i)
+		}
+		shortIDs = shortIDs[1:]
+	}
+	if len(missing) > 0 {
+		return nil, missing, nil
+	}
+
+	// A block whose transactions were all sent and still do not match its
+	// header is returned as is, to be rejected by block validation
+	block := &Block{Header: cb.Header, Content: BlockContent{Transactions: transactions}, Hash: cb.Hash}
+	if contentHash, err := block.CalculateContentHash(); len(shortened) > 0 && (err != nil || contentHash != cb.Header.ContentHash) {
+		return nil, shortened, nil
+	}
+	return block, nil, nil
+}
+
+func (cb *CompactBlock) shortIDKey() []byte {
+	data := []byte(cb.Hash)
+	data = binary.BigEndian.AppendUint64(data, cb.Nonce)
+	key := sha256.Sum256(data)
+	return key[:]
+}
+
+func shortTxID(key []byte, txHash string) uint64 {
+	raw, err := hex.DecodeString(txHash)
+	if err != nil {
+		raw = []byte(txHash)
+	}
+	hash := sha256.Sum256(append(append([]byte{}, key...), raw...))
+	var id [8]byte
+	copy(id[8-shortIDBytes:], hash[:shortIDBytes])
+	return binary.BigEndian.Uint64(id[:])
+}
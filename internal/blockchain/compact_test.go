@@ -0,0 +1,88 @@
+package blockchain
+
+import "testing"
+
+func TestCompactBlockReconstruction(t *testing.T) {
+	alice := newTestKey(t)
+	utxos := []UTXO{
+		{TxID: "aa", Index: 0, Amount: 50, Address: alice.addr},
+		{TxID: "bb", Index: 0, Amount: 50, Address: alice.addr},
+	}
+	bc := NewBlockchain(utxos)
+	first := payment(t, utxos[0], alice, alice, 10, 1)
+	second := payment(t, utxos[1], alice, alice, 10, 2)
+	block, err := bc.CreateBlock("miner", []Transaction{*first, *second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine(t, block)
+
+	pool := NewTransactionPool()
+	if err := pool.AddTransaction(*first); err != nil {
+		t.Fatal(err)
+	}
+	compact := newCompactBlock(t, block, nil)
+	if len(compact.Prefilled) != 1 || len(compact.ShortIDs) != 2 {
+		t.Fatalf("%d prefilled and %d short ids, want the coinbase and 2", len(compact.Prefilled), len(compact.ShortIDs))
+	}
+
+	t.Run("missing transactions", func(t *testing.T) {
+		rebuilt, missing, err := compact.Reconstruct(pool)
+		if err != nil || rebuilt != nil || len(missing) != 1 || missing[0] != 2 {
+			t.Fatalf("missing %v, err %v, want [2]", missing, err)
+		}
+
+		rebuilt, missing, err = newCompactBlock(t, block, missing).Reconstruct(pool)
+		if err != nil || len(missing) != 0 || rebuilt == nil || rebuilt.Hash != block.Hash || !rebuilt.Verify() {
+			t.Fatalf("block not rebuilt with the missing transaction sent: %v", err)
+		}
+	})
+
+	t.Run("mismatching content", func(t *testing.T) {
+		full := NewTransactionPool()
+		for _, tx := range []*Transaction{first, second} {
+			if err := full.AddTransaction(*tx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		swapped := newCompactBlock(t, block, nil)
+		swapped.ShortIDs[0], swapped.ShortIDs[1] = swapped.ShortIDs[1], swapped.ShortIDs[0]
+		rebuilt, missing, err := swapped.Reconstruct(full)
+		if err != nil || rebuilt != nil || len(missing) != 2 {
+			t.Fatalf("transactions not matching the content hash: missing %v, err %v", missing, err)
+		}
+	})
+
+	t.Run("invalid prefilled positions", func(t *testing.T) {
+		duplicated := newCompactBlock(t, block, nil)
+		duplicated.Prefilled = append(duplicated.Prefilled, duplicated.Prefilled[0])
+		if _, _, err := duplicated.Reconstruct(pool); err == nil {
+			t.Fatal("repeated prefilled position accepted")
+		}
+		outOfRange := newCompactBlock(t, block, nil)
+		outOfRange.Prefilled[0].Index = 3
+		if _, _, err := outOfRange.Reconstruct(pool); err == nil {
+			t.Fatal("prefilled position past the last transaction accepted")
+		}
+	})
+
+	// With everything sent in full there is nothing to ask for, the block is
+	// left to validation
+	t.Run("all prefilled", func(t *testing.T) {
+		tampered := newCompactBlock(t, block, []int{1, 2})
+		tampered.Prefilled[1].Transaction, tampered.Prefilled[2].Transaction = tampered.Prefilled[2].Transaction, tampered.Prefilled[1].Transaction
+		rebuilt, missing, err := tampered.Reconstruct(NewTransactionPool())
+		if err != nil || len(missing) != 0 || rebuilt == nil || rebuilt.Verify() {
+			t.Fatalf("tampered block not returned for validation: missing %v, err %v", missing, err)
+		}
+	})
+}
+
+func newCompactBlock(t *testing.T, block *Block, prefill []int) *CompactBlock {
+	t.Helper()
+	compact, err := NewCompactBlock(block, prefill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compact
+}
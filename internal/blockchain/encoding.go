@@ -0,0 +1,346 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Encoding versions of block headers and transactions. Objects of version
+// LegacyEncoding are hashed as their JSON encoding, as all nodes did before the
+// canonical binary encoding. They remain valid so existing chains keep working.
+const (
+	LegacyEncoding    = 0
+	CanonicalEncoding = 1
+)
+
+// EncodingVersion is the version of the blocks and transactions this node
+// creates. Set it to LegacyEncoding while the network still has nodes that only
+// understand legacy hashes.
+var EncodingVersion = CanonicalEncoding
+
+var ErrBadEncoding = errors.New("malformed encoding")
+
+// The canonical encoding of an object starts with its version byte, followed
+// by its fields in declaration order. Integers are 8 byte big endian, strings
+// and lists are prefixed by their length as an unsigned varint.
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) version(v int) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *encoder) int(v int64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+}
+
+func (e *encoder) length(n int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(n))
+}
+
+func (e *encoder) string(s string) {
+	e.length(len(s))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) utxo(u UTXO) {
+	e.string(u.TxID)
+	e.int(int64(u.Index))
+	e.int(u.Amount)
+	e.string(u.Address)
+	e.string(u.LockScript)
+	e.int(u.LockTime)
+}
+
+func (e *encoder) utxos(utxos []UTXO) {
+	e.length(len(utxos))
+	for _, u := range utxos {
+		e.utxo(u)
+	}
+}
+
+func (e *encoder) header(h BlockHeader) {
+	e.version(h.Version)
+	e.int(h.Timestamp)
+	e.string(h.PreviousHash)
+	e.string(h.ContentHash)
+	e.int(int64(h.Height))
+	e.string(h.Difficulty)
+	e.int(h.Nonce)
+}
+
+func (e *encoder) content(c TransactionContent) {
+	e.version(c.Version)
+	e.utxos(c.InputUTXOs)
+	e.utxos(c.OutputUTXOs)
+	e.string(c.SenderPubKey)
+	e.int(c.Timestamp)
+	e.int(int64(c.Height))
+	e.int(c.LockTime)
+}
+
+func (e *encoder) transaction(tx Transaction) {
+	e.content(tx.Content)
+	e.string(tx.Signature)
+	e.string(tx.Hash)
+	e.length(len(tx.Witnesses))
+	for _, w := range tx.Witnesses {
+		e.string(w.PubKey)
+		e.string(w.Signature)
+		e.string(w.UnlockScript)
+	}
+}
+
+func (e *encoder) block(b *Block) {
+	e.header(b.Header)
+	e.string(b.Hash)
+	e.length(len(b.Content.Transactions))
+	for _, tx := range b.Content.Transactions {
+		e.transaction(tx)
+	}
+}
+
+// decoder reads what encoder wrote. The first error is kept and turns every
+// later read into a no-op, so callers only check err once at the end.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) version() int {
+	if d.err != nil || len(d.data) < 1 {
+		d.fail("missing version")
+		return 0
+	}
+	v := int(d.data[0])
+	if v > CanonicalEncoding {
+		d.fail("unknown version %d", v)
+	}
+	d.data = d.data[1:]
+	return v
+}
+
+func (d *decoder) int() int64 {
+	if d.err != nil || len(d.data) < 8 {
+		d.fail("truncated integer")
+		return 0
+	}
+	v := int64(binary.BigEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return v
+}
+
+// length reads a length prefix, which can be at most the remaining bytes as
+// every element takes at least one.
+func (d *decoder) length() int {
+	if d.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 || n > uint64(len(d.data)-size) {
+		d.fail("invalid length")
+		return 0
+	}
+	d.data = d.data[size:]
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	n := d.length()
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *decoder) utxo() UTXO {
+	return UTXO{
+		TxID:       d.string(),
+		Index:      int(d.int()),
+		Amount:     d.int(),
+		Address:    d.string(),
+		LockScript: d.string(),
+		LockTime:   d.int(),
+	}
+}
+
+func (d *decoder) utxos() []UTXO {
+	utxos := []UTXO{}
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		utxos = append(utxos, d.utxo())
+	}
+	return utxos
+}
+
+func (d *decoder) header() BlockHeader {
+	return BlockHeader{
+		Version:      d.version(),
+		Timestamp:    d.int(),
+		PreviousHash: d.string(),
+		ContentHash:  d.string(),
+		Height:       int(d.int()),
+		Difficulty:   d.string(),
+		Nonce:        d.int(),
+	}
+}
+
+func (d *decoder) content() TransactionContent {
+	return TransactionContent{
+		Version:      d.version(),
+		InputUTXOs:   d.utxos(),
+		OutputUTXOs:  d.utxos(),
+		SenderPubKey: d.string(),
+		Timestamp:    d.int(),
+		Height:       int(d.int()),
+		LockTime:     d.int(),
+	}
+}
+
+func (d *decoder) transaction() Transaction {
+	tx := Transaction{
+		Content:   d.content(),
+		Signature: d.string(),
+		Hash:      d.string(),
+	}
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		tx.Witnesses = append(tx.Witnesses, InputWitness{
+			PubKey:       d.string(),
+			Signature:    d.string(),
+			UnlockScript: d.string(),
+		})
+	}
+	return tx
+}
+
+func (d *decoder) block() *Block {
+	b := &Block{Header: d.header(), Hash: d.string()}
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		b.Content.Transactions = append(b.Content.Transactions, d.transaction())
+	}
+	return b
+}
+
+// finish returns the decoding error, if any, or an error if data is left over.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("%d trailing bytes", len(d.data))
+	}
+	return d.err
+}
+
+// Encode returns the canonical encoding of the header, which its hash covers
+// from CanonicalEncoding on.
+func (h *BlockHeader) Encode() []byte {
+	var e encoder
+	e.header(*h)
+	return e.buf
+}
+
+// Encode returns the canonical encoding of the content, which the hash and the
+// signatures of a transaction cover from CanonicalEncoding on.
+func (c *TransactionContent) Encode() []byte {
+	var e encoder
+	e.content(*c)
+	return e.buf
+}
+
+// Encode returns the canonical encoding of the UTXO.
+func (u *UTXO) Encode() []byte {
+	var e encoder
+	e.version(CanonicalEncoding)
+	e.utxo(*u)
+	return e.buf
+}
+
+func DecodeBlockHeader(data []byte) (BlockHeader, error) {
+	d := decoder{data: data}
+	h := d.header()
+	return h, d.finish()
+}
+
+func DecodeTransactionContent(data []byte) (TransactionContent, error) {
+	d := decoder{data: data}
+	c := d.content()
+	return c, d.finish()
+}
+
+func DecodeUTXO(data []byte) (UTXO, error) {
+	d := decoder{data: data}
+	d.version()
+	u := d.utxo()
+	return u, d.finish()
+}
+
+// encodeBlock returns the canonical encoding of a whole block, with its
+// transactions' signatures and hashes, as kept on disk.
+func encodeBlock(b *Block) []byte {
+	var e encoder
+	e.block(b)
+	return e.buf
+}
+
+func decodeBlock(data []byte) (*Block, error) {
+	d := decoder{data: data}
+	b := d.block()
+	return b, d.finish()
+}
+
+// encodeSnapshot returns the canonical encoding of a UTXO snapshot, without
+// its checksum. UTXOs and coinbase heights are sorted so equal sets encode
+// equally.
+func encodeSnapshot(s *UTXOSnapshot) []byte {
+	var e encoder
+	e.version(CanonicalEncoding)
+	e.int(int64(s.Height))
+	e.string(s.BlockHash)
+
+	utxos := append([]UTXO{}, s.UTXOs...)
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].TxID != utxos[j].TxID {
+			return utxos[i].TxID < utxos[j].TxID
+		}
+		return utxos[i].Index < utxos[j].Index
+	})
+	e.utxos(utxos)
+
+	txIDs := make([]string, 0, len(s.CoinbaseHeights))
+	for txID := range s.CoinbaseHeights {
+		txIDs = append(txIDs, txID)
+	}
+	sort.Strings(txIDs)
+	e.length(len(txIDs))
+	for _, txID := range txIDs {
+		e.string(txID)
+		e.int(int64(s.CoinbaseHeights[txID]))
+	}
+	return e.buf
+}
+
+func decodeSnapshot(data []byte) (*UTXOSnapshot, error) {
+	d := decoder{data: data}
+	d.version()
+	s := &UTXOSnapshot{
+		Height:          int(d.int()),
+		BlockHash:       d.string(),
+		UTXOs:           d.utxos(),
+		CoinbaseHeights: make(map[string]int),
+	}
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		txID := d.string()
+		s.CoinbaseHeights[txID] = int(d.int())
+	}
+	s.Checksum = d.string()
+	return s, d.finish()
+}
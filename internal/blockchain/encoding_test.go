@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"nakamoto-blockchain/internal/crypto"
+	"nakamoto-blockchain/internal/script"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBlockEncodingRoundTrip(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	multisig, err := script.Multisig(1, []string{alice.pub, bob.pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := []UTXO{
+		{TxID: "aa", Index: 0, Amount: 50, Address: alice.addr, LockTime: 3},
+		{TxID: "bb", Index: 2, Amount: 20, Address: script.Address(multisig), LockScript: multisig},
+	}
+	locked, err := NewScriptPayment(script.PayToPubKeyHash(bob.addr), 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked.LockTime = LockTimeThreshold + 1000
+	tx, err := NewMultiSenderTransaction(inputs, []Payment{locked, {Address: alice.addr, Amount: 25}}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Content.LockTime = 2
+	if _, err := tx.SignInputs(alice.priv); err != nil {
+		t.Fatal(err)
+	}
+	sigHash, err := tx.SigHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := crypto.Sign(sigHash, alice.priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SetUnlockScript(1, script.MultisigUnlock([]string{signature})); err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := NewBlock(GenesisBlock().Hash, 1, initialDifficulty, []Transaction{coinbase(t, 1), *tx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Hash, err = block.CalculateHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := encodeBlock(block)
+	decoded, err := decodeBlock(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encodeBlock(decoded), encoded) {
+		t.Fatal("decoded block encodes differently")
+	}
+	if hash, err := decoded.CalculateHash(); err != nil || hash != block.Hash || decoded.Hash != block.Hash {
+		t.Fatalf("decoded block hashes to %s, want %s", hash, block.Hash)
+	}
+	if !reflect.DeepEqual(decoded.Content.Transactions[1].Witnesses, tx.Witnesses) || !reflect.DeepEqual(decoded.Content.Transactions[1].Content, tx.Content) {
+		t.Fatal("witnesses, lock times or scripts lost in the encoding")
+	}
+
+	if _, err := decodeBlock(encoded[:len(encoded)-1]); err == nil {
+		t.Fatal("truncated encoding decoded")
+	}
+	if _, err := decodeBlock(append(encoded, 0)); err == nil {
+		t.Fatal("encoding with trailing data decoded")
+	}
+}
+
+// legacyRecord returns block as a store record in the JSON format used before
+// the canonical encoding.
+func legacyRecord(t *testing.T, block *Block) []byte {
+	t.Helper()
+	payload, err := json.Marshal(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+func TestMigrateRewritesLegacyRecords(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	initial := []UTXO{{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}}
+	bc := NewBlockchain(initial)
+	mineOnTip(t, bc, *payment(t, initial[0], alice, bob, 30, 1))
+
+	dir := t.TempDir()
+	store, err := OpenFileBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segment []byte
+	for _, block := range bc.Blocks {
+		segment = append(segment, legacyRecord(t, block)...)
+	}
+	if err := os.WriteFile(store.segmentPath(0), segment, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, err := OpenBlockchain(initial, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := store.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != len(bc.Blocks) {
+		t.Fatalf("%d blocks migrated, want %d", migrated, len(bc.Blocks))
+	}
+	data, err := os.ReadFile(store.segmentPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isLegacyRecord(data) {
+		t.Fatal("segment still holds JSON records")
+	}
+	if migrated, err := store.Migrate(); err != nil || migrated != 0 {
+		t.Fatalf("second migration rewrote %d blocks: %v", migrated, err)
+	}
+	store.Close()
+
+	store, err = OpenFileBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	reopened, err := OpenBlockchain(initial, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, loaded := range []*Blockchain{legacy, reopened} {
+		if len(loaded.Blocks) != len(bc.Blocks) || loaded.GetLastBlock().Hash != bc.GetLastBlock().Hash {
+			t.Fatal("reloaded chain differs from the stored one")
+		}
+		for i, block := range loaded.Blocks {
+			if !bytes.Equal(encodeBlock(block), encodeBlock(bc.Blocks[i])) {
+				t.Fatalf("block %d differs after reloading", i)
+			}
+		}
+		if !reflect.DeepEqual(loaded.UTXOSet.All(), bc.UTXOSet.All()) {
+			t.Fatal("reloaded UTXO set differs")
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestHeaderWork(t *testing.T) {
+	easy := BlockHeader{Difficulty: "ffff"}
+	hard := BlockHeader{Difficulty: "ff"}
+	if easy.Work().Cmp(hard.Work()) >= 0 {
+		t.Fatal("a lower target must mean more work")
+	}
+	for _, difficulty := range []string{"", "0", "zz", "-1"} {
+		invalid := BlockHeader{Difficulty: difficulty}
+		if invalid.Work().Sign() != 0 {
+			t.Fatalf("difficulty %q has work", difficulty)
+		}
+	}
+}
+
+func TestChainWorkFollowsTip(t *testing.T) {
+	bc := NewBlockchain(nil)
+	block := mineOnTip(t, bc)
+	want := new(big.Int).Add(bc.Blocks[0].Header.Work(), block.Header.Work())
+	if bc.ChainWork().Cmp(want) != 0 {
+		t.Fatalf("chain work %v, want %v", bc.ChainWork(), want)
+	}
+
+	if _, err := bc.RollbackToHash(bc.Blocks[0].Hash); err != nil {
+		t.Fatal(err)
+	}
+	if bc.ChainWork().Cmp(bc.Blocks[0].Header.Work()) != 0 {
+		t.Fatal("chain work not rolled back")
+	}
+}
+
+func TestProcessBlockSwitchesToBranchWithMoreWork(t *testing.T) {
+	bc := NewBlockchain(nil)
+	m1 := mineOnTip(t, bc)
+	tip := mineOnTip(t, bc)
+
+	// A branch with as much work as the main chain is not switched to
+	s1 := mineOn(t, bc, bc.Blocks[0])
+	s2 := mineOn(t, bc, s1)
+	for _, block := range []*Block{s1, s2} {
+		reorg, err := bc.ProcessBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reorg != nil {
+			t.Fatalf("switched to a branch without more work at %s", block.Hash)
+		}
+	}
+	if bc.GetLastBlock().Hash != tip.Hash {
+		t.Fatal("tip changed")
+	}
+
+	s3 := mineOn(t, bc, s2)
+	reorg, err := bc.ProcessBlock(s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reorg == nil || len(reorg.Removed) != 2 || len(reorg.Added) != 3 {
+		t.Fatalf("unexpected reorganization %+v", reorg)
+	}
+	if reorg.Removed[0].Hash != tip.Hash || reorg.Removed[1].Hash != m1.Hash || reorg.Added[2].Hash != s3.Hash {
+		t.Fatal("reorganization lists the wrong blocks")
+	}
+	if bc.GetLastBlock().Hash != s3.Hash || bc.index.Lookup(tip.Hash).Status != BlockSideChain {
+		t.Fatal("main chain not switched")
+	}
+}
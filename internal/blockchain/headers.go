@@ -0,0 +1,111 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+)
+
+const locatorDenseHashes = 10 // locator hashes before their spacing starts doubling
+
+// MaxHeadersPerRequest is the number of headers returned for one locator.
+var MaxHeadersPerRequest = 2000
+
+var (
+	ErrUnknownHeaderParent = errors.New("headers do not connect to a known block")
+	ErrBadHeaderChain      = errors.New("invalid header chain")
+)
+
+// BlockLocator returns hashes of main chain blocks from the tip back to the
+// genesis block, one apart for the newest blocks and then exponentially spaced.
+// A peer finds the newest block we have in common from it in a few dozen hashes,
+// however deep the fork.
+func (bc *Blockchain) BlockLocator() []string {
+	var locator []string
+	step := 1
+	for height := len(bc.Blocks) - 1; height > 0; height -= step {
+		locator = append(locator, bc.Blocks[height].Hash)
+		if len(locator) >= locatorDenseHashes {
+			step *= 2
+		}
+	}
+	return append(locator, bc.Blocks[0].Hash)
+}
+
+// FindCommonAncestor returns the newest block of a peer's locator that is on
+// our main chain, which is the genesis block if no other is.
+func (bc *Blockchain) FindCommonAncestor(locator []string) *Block {
+	for _, hash := range locator {
+		if height, exists := bc.heights[hash]; exists {
+			return bc.Blocks[height]
+		}
+	}
+	return bc.Blocks[0]
+}
+
+// LocateHeaders returns the headers of the main chain blocks following the
+// common ancestor with locator. At most max headers are returned, ending early
+// at stopHash.
+func (bc *Blockchain) LocateHeaders(locator []string, stopHash string, max int) []BlockHeader {
+	var headers []BlockHeader
+	for height := bc.FindCommonAncestor(locator).Header.Height + 1; height < len(bc.Blocks) && len(headers) < max; height++ {
+		headers = append(headers, bc.Blocks[height].Header)
+		if bc.Blocks[height].Hash == stopHash {
+			break
+		}
+	}
+	return headers
+}
+
+// CheckHeaders validates headers received from a peer before downloading their
+// blocks. They must follow each other, the first one extending parent or, if
+// parent is nil, an indexed block, and each must carry a valid proof of work and
+// pass the header checks blocks are subject to. The returned nodes hold the
+// hash and chain work of each header; they are not added to the index, but the
+// last one can be passed as parent for the next batch of headers.
+func (bc *Blockchain) CheckHeaders(headers []BlockHeader, parent *BlockNode) ([]*BlockNode, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	if parent == nil {
+		if parent = bc.index.Lookup(headers[0].PreviousHash); parent == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownHeaderParent, headers[0].PreviousHash)
+		}
+	}
+	if parent.Status == BlockInvalid {
+		return nil, fmt.Errorf("%w: extends invalid block %s", ErrBadHeaderChain, parent.Hash)
+	}
+
+	nodes := make([]*BlockNode, 0, len(headers))
+	for _, header := range headers {
+		block := &Block{Header: header}
+		hash, err := block.CalculateHash()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadHeaderChain, err)
+		}
+		block.Hash = hash
+		if !block.VerifyHash(hash) {
+			return nil, fmt.Errorf("%w: header %s does not meet its difficulty", ErrBadHeaderChain, hash)
+		}
+		if err := checkBlockHeader(block, parent); err != nil {
+			return nil, fmt.Errorf("%w: header %s: %v", ErrBadHeaderChain, hash, err)
+		}
+
+		if known := bc.index.Lookup(hash); known != nil {
+			if known.Status == BlockInvalid {
+				return nil, fmt.Errorf("%w: header %s belongs to an invalid block", ErrBadHeaderChain, hash)
+			}
+			parent = known
+		} else {
+			work := header.Work()
+			parent = &BlockNode{
+				Hash:      hash,
+				Header:    header,
+				Parent:    parent,
+				ChainWork: work.Add(work, parent.ChainWork),
+				Status:    BlockSideChain,
+			}
+		}
+		nodes = append(nodes, parent)
+	}
+	return nodes, nil
+}
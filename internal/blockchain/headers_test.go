@@ -0,0 +1,114 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// locatorChain returns a chain of n stored blocks, set up for the locator
+// lookups only. Blocks past height fork are named with prefix, so chains
+// built with the same fork share the blocks up to it.
+func locatorChain(n, fork int, prefix string) *Blockchain {
+	bc := NewBlockchain(nil)
+	bc.Blocks = nil
+	bc.heights = make(map[string]int)
+	for height := 0; height < n; height++ {
+		block := storedBlock(height)
+		if height > fork {
+			block.Hash = fmt.Sprint(prefix, height)
+		}
+		bc.Blocks = append(bc.Blocks, block)
+		bc.indexBlock(block)
+	}
+	return bc
+}
+
+func headerHeights(headers []BlockHeader) []int {
+	var heights []int
+	for _, header := range headers {
+		heights = append(heights, header.Height)
+	}
+	return heights
+}
+
+func TestBlockLocatorSpacing(t *testing.T) {
+	tests := []struct {
+		blocks  int
+		heights []int
+	}{
+		{1, []int{0}},
+		{5, []int{4, 3, 2, 1, 0}},
+		{100, []int{99, 98, 97, 96, 95, 94, 93, 92, 91, 90, 88, 84, 76, 60, 28, 0}},
+	}
+	for _, test := range tests {
+		bc := locatorChain(test.blocks, test.blocks, "")
+		var heights []int
+		for _, hash := range bc.BlockLocator() {
+			heights = append(heights, bc.heights[hash])
+		}
+		if !reflect.DeepEqual(heights, test.heights) {
+			t.Errorf("locator of %d blocks has heights %v, want %v", test.blocks, heights, test.heights)
+		}
+	}
+}
+
+func TestLocateHeadersFindsForkPoint(t *testing.T) {
+	ours := locatorChain(100, 100, "")
+	// The peer's chain leaves ours after block 50; the newest block its
+	// locator has in common with ours is block 28
+	locator := locatorChain(100, 50, "fork").BlockLocator()
+	if ancestor := ours.FindCommonAncestor(locator); ancestor.Header.Height != 28 {
+		t.Fatalf("common ancestor at height %d, want 28", ancestor.Header.Height)
+	}
+
+	if heights := headerHeights(ours.LocateHeaders(locator, "", 5)); !reflect.DeepEqual(heights, []int{29, 30, 31, 32, 33}) {
+		t.Fatalf("headers at heights %v for at most 5 headers", heights)
+	}
+	if heights := headerHeights(ours.LocateHeaders(locator, ours.Blocks[31].Hash, 5)); !reflect.DeepEqual(heights, []int{29, 30, 31}) {
+		t.Fatalf("headers at heights %v up to block 31", heights)
+	}
+	if headers := ours.LocateHeaders(ours.BlockLocator(), "", 5); len(headers) != 0 {
+		t.Fatalf("%d headers returned to a peer on our tip", len(headers))
+	}
+	if heights := headerHeights(ours.LocateHeaders([]string{"unknown"}, "", 2)); !reflect.DeepEqual(heights, []int{1, 2}) {
+		t.Fatalf("headers at heights %v for an unknown locator, want them from the genesis block", heights)
+	}
+}
+
+func TestCheckHeaders(t *testing.T) {
+	bc := NewBlockchain(nil)
+	first, second := mineOnTip(t, bc), mineOnTip(t, bc)
+	headers := []BlockHeader{first.Header, second.Header}
+
+	peer := NewBlockchain(nil)
+	if found := bc.LocateHeaders(peer.BlockLocator(), "", MaxHeadersPerRequest); !reflect.DeepEqual(found, headers) {
+		t.Fatal("headers following the genesis block not located")
+	}
+	nodes, err := peer.CheckHeaders(headers, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[1].Hash != second.Hash || nodes[1].Parent != nodes[0] || nodes[1].ChainWork.Cmp(bc.ChainWork()) != 0 {
+		t.Fatal("checked headers do not carry the hashes and chain work of the blocks")
+	}
+	if peer.index.Lookup(first.Hash) != nil {
+		t.Fatal("checked header added to the index")
+	}
+
+	if _, err := peer.CheckHeaders(headers[1:], nil); !errors.Is(err, ErrUnknownHeaderParent) {
+		t.Fatalf("headers with an unknown parent: %v", err)
+	}
+	if _, err := peer.CheckHeaders(headers[1:], nodes[0]); err != nil {
+		t.Fatalf("next batch of headers rejected: %v", err)
+	}
+	if _, err := bc.CheckHeaders([]BlockHeader{second.Header, first.Header}, nil); !errors.Is(err, ErrBadHeaderChain) {
+		t.Fatalf("headers out of order: %v", err)
+	}
+	forged := first.Header
+	forged.Nonce++
+	if _, err := peer.CheckHeaders([]BlockHeader{forged}, nil); !errors.Is(err, ErrBadHeaderChain) {
+		t.Fatalf("header without proof of work: %v", err)
+	}
+}
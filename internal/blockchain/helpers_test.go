@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"nakamoto-blockchain/internal/crypto"
+	"nakamoto-blockchain/logger"
+	"os"
+	"testing"
+)
+
+func init() {
+	logger.Init(os.DevNull)
+}
+
+type testKey struct {
+	pub, priv, addr string
+}
+
+func newTestKey(t *testing.T) testKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	privBytes, _ := x509.MarshalECPrivateKey(key)
+	pub := base64.StdEncoding.EncodeToString(pubBytes)
+	return testKey{pub: pub, priv: base64.StdEncoding.EncodeToString(privBytes), addr: crypto.Key2Addr(pub)}
+}
+
+// mine finds a nonce meeting the block's difficulty and sets its hash.
+func mine(t *testing.T, block *Block) *Block {
+	t.Helper()
+	for {
+		hash, err := block.CalculateHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.VerifyHash(hash) {
+			block.Hash = hash
+			return block
+		}
+		block.Header.Nonce++
+	}
+}
+
+// mineOnTip creates, mines and adds a block with transactions to bc.
+func mineOnTip(t *testing.T, bc *Blockchain, transactions ...Transaction) *Block {
+	t.Helper()
+	block, err := bc.CreateBlock("miner", transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddBlock(mine(t, block)); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// mineOn mines a block extending parent, holding a coinbase and transactions.
+func mineOn(t *testing.T, bc *Blockchain, parent *Block, transactions ...Transaction) *Block {
+	t.Helper()
+	height := parent.Header.Height + 1
+	block, err := NewBlock(parent.Hash, height, bc.GetDifficulty(height), append([]Transaction{coinbase(t, height)}, transactions...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mine(t, block)
+}
+
+func coinbase(t *testing.T, height int) Transaction {
+	t.Helper()
+	tx, err := NewCoinbaseTransaction("miner", height, BlockSubsidy(height))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *tx
+}
+
+// payment returns a signed transaction sending amount of the input owned by
+// from to to, paying fee and returning the change to from.
+func payment(t *testing.T, input UTXO, from, to testKey, amount, fee int64) *Transaction {
+	t.Helper()
+	tx, err := NewTransaction([]UTXO{input}, from.pub, to.pub, amount, fee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Sign(from.priv); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
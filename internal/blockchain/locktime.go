@@ -0,0 +1,29 @@
+package blockchain
+
+// Lock times below LockTimeThreshold are block heights, larger ones are unix
+// timestamps in milliseconds. Zero means no lock.
+const LockTimeThreshold = 500000000
+
+// lockTimeReached reports whether lockTime has passed for a block at height
+// with the given timestamp.
+func lockTimeReached(lockTime int64, height int, timestamp int64) bool {
+	if lockTime < LockTimeThreshold {
+		return int64(height) >= lockTime
+	}
+	return timestamp >= lockTime
+}
+
+// IsFinal reports whether tx may be included in a block at height with the
+// given timestamp: its own lock time and those of the outputs it spends have
+// passed.
+func (tx *Transaction) IsFinal(height int, timestamp int64) bool {
+	if !lockTimeReached(tx.Content.LockTime, height, timestamp) {
+		return false
+	}
+	for _, utxo := range tx.Content.InputUTXOs {
+		if !lockTimeReached(utxo.LockTime, height, timestamp) {
+			return false
+		}
+	}
+	return true
+}
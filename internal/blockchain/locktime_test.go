@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"testing"
+	"time"
+)
+
+// lockedPayment returns a signed payment that cannot be mined before lockTime.
+func lockedPayment(t *testing.T, input UTXO, from, to testKey, lockTime int64) *Transaction {
+	t.Helper()
+	tx, err := NewTransaction([]UTXO{input}, from.pub, to.pub, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Content.LockTime = lockTime
+	if err := tx.Sign(from.priv); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestIsFinal(t *testing.T) {
+	now := time.Now().UnixMilli()
+	tests := []struct {
+		name      string
+		lockTime  int64
+		height    int
+		timestamp int64
+		final     bool
+	}{
+		{"no lock", 0, 0, 0, true},
+		{"below lock height", 5, 4, now, false},
+		{"at lock height", 5, 5, 0, true},
+		{"above lock height", 5, 6, 0, true},
+		{"largest lock height", LockTimeThreshold - 1, LockTimeThreshold - 2, now, false},
+		{"at largest lock height", LockTimeThreshold - 1, LockTimeThreshold - 1, 0, true},
+		{"before lock time", now, 1000, now - 1, false},
+		{"at lock time", now, 0, now, true},
+		{"after lock time", now, 0, now + 1, true},
+		{"before smallest lock time", LockTimeThreshold, LockTimeThreshold, LockTimeThreshold - 1, false},
+		{"at smallest lock time", LockTimeThreshold, 0, LockTimeThreshold, true},
+	}
+	for _, test := range tests {
+		tx := Transaction{Content: TransactionContent{LockTime: test.lockTime}}
+		if final := tx.IsFinal(test.height, test.timestamp); final != test.final {
+			t.Errorf("%s: IsFinal(%d, %d) = %v with lock time %d", test.name, test.height, test.timestamp, final, test.lockTime)
+		}
+
+		// The lock time of a spent output binds the same way
+		tx = Transaction{Content: TransactionContent{InputUTXOs: []UTXO{{LockTime: test.lockTime}}}}
+		if final := tx.IsFinal(test.height, test.timestamp); final != test.final {
+			t.Errorf("%s: IsFinal(%d, %d) = %v with input lock time %d", test.name, test.height, test.timestamp, final, test.lockTime)
+		}
+	}
+}
+
+func TestCheckLockTime(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, utxoSet, pool := fundedPool(t, alice, 1)
+	utxoSet.height = 7
+
+	if !pool.CheckLockTime(*lockedPayment(t, utxos[0], alice, bob, int64(8+MaxPoolLockBlocks)), utxoSet) {
+		t.Fatal("transaction final within MaxPoolLockBlocks refused")
+	}
+	if pool.CheckLockTime(*lockedPayment(t, utxos[0], alice, bob, int64(9+MaxPoolLockBlocks)), utxoSet) {
+		t.Fatal("transaction locked beyond MaxPoolLockBlocks accepted")
+	}
+	if pool.CheckLockTime(*lockedPayment(t, utxos[0], alice, bob, time.Now().Add(2*MaxPoolLockTime).UnixMilli()), utxoSet) {
+		t.Fatal("transaction locked beyond MaxPoolLockTime accepted")
+	}
+}
+
+func TestBlockTemplateSkipsNonFinalTransactions(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, utxoSet, pool := fundedPool(t, alice, 1)
+	tx := lockedPayment(t, utxos[0], alice, bob, 3)
+	if err := pool.AddTransaction(*tx); err != nil {
+		t.Fatal(err)
+	}
+
+	utxoSet.height = 1
+	if template := pool.GetBlockTemplate(utxoSet, MaxBlockSize); len(template) != 0 {
+		t.Fatal("transaction locked to height 3 selected for block 2")
+	}
+	utxoSet.height = 2
+	if template := pool.GetBlockTemplate(utxoSet, MaxBlockSize); len(template) != 1 || template[0].Hash != tx.Hash {
+		t.Fatal("transaction locked to height 3 not selected for block 3")
+	}
+}
+
+func TestBlockWithNonFinalTransactionRejected(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	initial := []UTXO{{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}}
+	bc := NewBlockchain(initial)
+
+	block, err := bc.CreateBlock("miner", []Transaction{*lockedPayment(t, initial[0], alice, bob, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddBlock(mine(t, block)); err == nil {
+		t.Fatal("block 1 with a transaction locked to height 2 accepted")
+	}
+	if len(bc.Blocks) != 1 || bc.UTXOSet.Balance(alice.addr) != 100 {
+		t.Fatal("rejected block changed the chain")
+	}
+}
@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// The content hash of a canonical block is the root of a Merkle tree over its
+// transaction hashes, so a transaction can be proven part of a block with a
+// handful of hashes instead of the whole block. Leaves and inner nodes are
+// hashed with different prefixes, so an inner node never passes for a
+// transaction. A node without a sibling moves up a level unchanged, and the
+// root also commits to the number of transactions, fixing the shape of the
+// tree and thereby the position a proof claims.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+	merkleRootPrefix = 0x02
+)
+
+var ErrTxNotFound = errors.New("transaction not found")
+
+// MerkleProof links a transaction to the content hash of its block.
+type MerkleProof struct {
+	TxHash   string
+	Index    int      // position of the transaction in its block
+	Count    int      // number of transactions in the block
+	Siblings []string // sibling hashes from the leaves up
+}
+
+// MerkleRoot returns the Merkle root over the given transaction hashes.
+func MerkleRoot(txHashes []string) (string, error) {
+	level, err := merkleLeaves(txHashes)
+	if err != nil {
+		return "", err
+	}
+	for len(level) > 1 {
+		level = nextMerkleLevel(level)
+	}
+	var top []byte
+	if len(level) == 1 {
+		top = level[0]
+	}
+	return merkleRoot(top, len(txHashes)), nil
+}
+
+// NewMerkleProof returns the proof for the transaction at index among
+// txHashes.
+func NewMerkleProof(txHashes []string, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(txHashes) {
+		return nil, fmt.Errorf("%w: index %d of %d", ErrTxNotFound, index, len(txHashes))
+	}
+	level, err := merkleLeaves(txHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &MerkleProof{TxHash: txHashes[index], Index: index, Count: len(txHashes)}
+	for i := index; len(level) > 1; i /= 2 {
+		if sibling := i ^ 1; sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, hex.EncodeToString(level[sibling]))
+		}
+		level = nextMerkleLevel(level)
+	}
+	return proof, nil
+}
+
+// Verify reports whether the proof leads from its transaction to root.
+func (p *MerkleProof) Verify(root string) bool {
+	if p.Index < 0 || p.Index >= p.Count {
+		return false
+	}
+	hash, err := merkleLeaf(p.TxHash)
+	if err != nil {
+		return false
+	}
+
+	siblings := p.Siblings
+	for i, n := p.Index, p.Count; n > 1; i, n = i/2, (n+1)/2 {
+		if i^1 >= n {
+			continue
+		}
+		if len(siblings) == 0 {
+			return false
+		}
+		sibling, err := hex.DecodeString(siblings[0])
+		if err != nil {
+			return false
+		}
+		siblings = siblings[1:]
+		if i%2 == 0 {
+			hash = merkleNode(hash, sibling)
+		} else {
+			hash = merkleNode(sibling, hash)
+		}
+	}
+	return len(siblings) == 0 && merkleRoot(hash, p.Count) == root
+}
+
+// VerifyMerkleProof reports whether proof shows its transaction is part of the
+// block with the given header. This is all a light client needs besides a
+// header chain whose proof of work it checked. Legacy blocks have no Merkle
+// root, so nothing can be proven against them.
+func VerifyMerkleProof(header *BlockHeader, proof *MerkleProof) bool {
+	return header.Version >= CanonicalEncoding && proof.Verify(header.ContentHash)
+}
+
+func merkleLeaf(txHash string) ([]byte, error) {
+	raw, err := hex.DecodeString(txHash)
+	if err != nil || len(raw) == 0 {
+		return nil, fmt.Errorf("invalid transaction hash %q", txHash)
+	}
+	hash := sha256.Sum256(append([]byte{merkleLeafPrefix}, raw...))
+	return hash[:], nil
+}
+
+func merkleLeaves(txHashes []string) ([][]byte, error) {
+	level := make([][]byte, len(txHashes))
+	for i, txHash := range txHashes {
+		leaf, err := merkleLeaf(txHash)
+		if err != nil {
+			return nil, err
+		}
+		level[i] = leaf
+	}
+	return level, nil
+}
+
+func merkleNode(left, right []byte) []byte {
+	data := make([]byte, 0, 1+len(left)+len(right))
+	data = append(data, merkleNodePrefix)
+	data = append(data, left...)
+	data = append(data, right...)
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+func nextMerkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+	}
+	return next
+}
+
+func merkleRoot(top []byte, count int) string {
+	data := []byte{merkleRootPrefix}
+	data = binary.BigEndian.AppendUint64(data, uint64(count))
+	data = append(data, top...)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
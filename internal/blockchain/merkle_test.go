@@ -0,0 +1,76 @@
+package blockchain
+
+import (
+	"fmt"
+	"nakamoto-blockchain/internal/crypto"
+	"testing"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		var hashes []string
+		for i := 0; i < n; i++ {
+			hashes = append(hashes, crypto.HashBytes([]byte(fmt.Sprint(i))))
+		}
+		root, err := MerkleRoot(hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < n; i++ {
+			proof, err := NewMerkleProof(hashes, i)
+			if err != nil || !proof.Verify(root) {
+				t.Fatalf("proof of transaction %d of %d rejected: %v", i, n, err)
+			}
+
+			wrongCount := *proof
+			wrongCount.Count = n + 1
+			if wrongCount.Verify(root) {
+				t.Fatalf("proof of transaction %d of %d verified with count %d", i, n, n+1)
+			}
+			if n == 1 {
+				continue
+			}
+			wrongIndex := *proof
+			wrongIndex.Index = (i + 1) % n
+			if wrongIndex.Verify(root) {
+				t.Fatalf("proof of transaction %d of %d verified at index %d", i, n, wrongIndex.Index)
+			}
+			wrongTx := *proof
+			wrongTx.TxHash = hashes[(i+1)%n]
+			if wrongTx.Verify(root) {
+				t.Fatalf("proof of transaction %d of %d verified for another transaction", i, n)
+			}
+		}
+
+		// Repeating the last transaction must not give the same root
+		if n%2 == 1 {
+			if duplicated, _ := MerkleRoot(append(append([]string{}, hashes...), hashes[n-1])); duplicated == root {
+				t.Fatalf("%d transactions have the root of %d", n+1, n)
+			}
+		}
+	}
+
+	if _, err := MerkleRoot([]string{"not hex"}); err == nil {
+		t.Fatal("root over an invalid hash")
+	}
+}
+
+func TestGetMerkleProofOfMinedTransaction(t *testing.T) {
+	alice := newTestKey(t)
+	input := UTXO{TxID: "aa", Index: 0, Amount: 50, Address: alice.addr}
+	bc := NewBlockchain([]UTXO{input})
+	tx := payment(t, input, alice, alice, 10, 1)
+	block := mineOnTip(t, bc, *tx)
+
+	proof, mined, err := bc.GetMerkleProof(tx.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mined.Hash != block.Hash || proof.Index != 1 || !VerifyMerkleProof(&mined.Header, proof) {
+		t.Fatal("proof does not link the transaction to its block")
+	}
+	if _, _, err := bc.GetMerkleProof(crypto.HashBytes([]byte("unknown"))); err == nil {
+		t.Fatal("proof of an unknown transaction")
+	}
+}
@@ -0,0 +1,84 @@
+package blockchain
+
+import "testing"
+
+func TestReplaceWithForkRestoresChainOnInvalidBlock(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	initial := []UTXO{{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}}
+	bc := NewBlockchain(initial)
+	mineOnTip(t, bc, *payment(t, initial[0], alice, bob, 30, 0))
+	mineOnTip(t, bc)
+	utxos := len(bc.UTXOSet.All())
+	tip := bc.GetLastBlock().Hash
+
+	// The second fork block spends an output that does not exist
+	bad := payment(t, UTXO{TxID: "missing", Index: 0, Amount: 5, Address: alice.addr}, alice, bob, 5, 0)
+	f1 := mineOn(t, bc, bc.Blocks[0])
+	f2 := mineOn(t, bc, f1, *bad)
+	f3 := mineOn(t, bc, f2)
+	if _, err := bc.ReplaceWithFork([]*Block{f1, f2, f3}); err == nil {
+		t.Fatal("fork with an invalid block accepted")
+	}
+
+	if bc.GetLastBlock().Hash != tip || len(bc.Blocks) != 3 {
+		t.Fatalf("chain not restored: tip %s, %d blocks", bc.GetLastBlock().Hash, len(bc.Blocks))
+	}
+	if len(bc.UTXOSet.All()) != utxos || bc.UTXOSet.Balance(bob.addr) != 30 {
+		t.Fatal("UTXO set not restored")
+	}
+}
+
+func TestReplaceWithForkPersistsNewBranch(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	initial := []UTXO{{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}}
+	dir := t.TempDir()
+	store, err := OpenFileBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := OpenBlockchain(initial, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := payment(t, initial[0], alice, bob, 30, 0)
+	mined := mineOnTip(t, bc, *tx)
+	mineOnTip(t, bc)
+
+	f1 := mineOn(t, bc, bc.Blocks[0])
+	f2 := mineOn(t, bc, f1)
+	f3 := mineOn(t, bc, f2)
+	removed, err := bc.ReplaceWithFork([]*Block{f1, f2, f3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Fatalf("%d blocks removed, want 2", len(removed))
+	}
+	if bc.UTXOSet.Balance(alice.addr) != 100 || bc.UTXOSet.Balance(bob.addr) != 0 {
+		t.Fatal("payment of the stale branch still applied")
+	}
+
+	// The stale payment goes back to the pool until a block mines it again
+	pool := NewTransactionPool()
+	pool.HandleStaleBlocks(removed, bc.UTXOSet)
+	if !pool.HasTransaction(tx.Hash) {
+		t.Fatal("stale transaction not returned to the pool")
+	}
+	pool.HandleConnectedBlocks([]*Block{mined})
+	if pool.HasTransaction(tx.Hash) {
+		t.Fatal("mined transaction left in the pool")
+	}
+
+	store.Close()
+	store, err = OpenFileBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenBlockchain(initial, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.GetLastBlock().Hash != f3.Hash {
+		t.Fatal("fork not persisted")
+	}
+}
@@ -0,0 +1,75 @@
+package blockchain
+
+import "fmt"
+
+// Replacement parameters, limiting how cheaply pool transactions can be
+// replaced and so how much relaying a sender can cause for little fee.
+var (
+	IncrementalFeeRate int64 = 1   // fee per 1000 bytes of the replacement it pays beyond all the transactions it replaces
+	MaxReplacements          = 100 // most pool transactions one replacement may evict
+)
+
+// ReplacementFeeBump returns the fee a replacement of size bytes must pay
+// beyond the transactions it replaces, so that it pays for its own relay.
+func ReplacementFeeBump(size int) int64 {
+	return (IncrementalFeeRate*int64(size) + 999) / 1000
+}
+
+// checkReplacement returns the pool transactions tx would replace: those
+// spending the same outpoints as tx and their descendants. tx may replace them
+// only if it
+//   - pays a higher fee rate than each transaction it directly conflicts with,
+//   - pays at least ReplacementFeeBump of its size more than all of them together,
+//   - replaces no more than MaxReplacements transactions and
+//   - does not spend outputs of a transaction it replaces.
+func (tp *TransactionPool) checkReplacement(tx Transaction) ([]string, error) {
+	var conflicts []string
+	seen := make(map[string]bool)
+	for _, utxo := range tx.Content.InputUTXOs {
+		if spender, exists := tp.spent[utxo.OutPoint()]; exists && !seen[spender] {
+			seen[spender] = true
+			conflicts = append(conflicts, spender)
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+
+	fee, size := tx.Fee(), tx.Size()
+	for _, hash := range conflicts {
+		original := tp.entries[hash]
+		if fee*int64(original.size) <= original.fee*int64(size) {
+			return nil, fmt.Errorf("transaction %s conflicts with pool transaction %s and does not pay a higher fee rate", tx.Hash, hash)
+		}
+	}
+
+	var replaced []string
+	replacedSet := make(map[string]bool)
+	for _, hash := range conflicts {
+		for _, descendant := range tp.descendants(hash) {
+			if !replacedSet[descendant] {
+				replacedSet[descendant] = true
+				replaced = append(replaced, descendant)
+			}
+		}
+	}
+	if len(replaced) > MaxReplacements {
+		return nil, fmt.Errorf("transaction %s would replace %d pool transactions, more than %d", tx.Hash, len(replaced), MaxReplacements)
+	}
+
+	for _, utxo := range tx.Content.InputUTXOs {
+		if replacedSet[utxo.TxID] {
+			return nil, fmt.Errorf("transaction %s spends an output of pool transaction %s it replaces", tx.Hash, utxo.TxID)
+		}
+	}
+
+	var replacedFee int64
+	for _, hash := range replaced {
+		replacedFee += tp.entries[hash].fee
+	}
+	if required := replacedFee + ReplacementFeeBump(size); fee < required {
+		return nil, fmt.Errorf("transaction %s pays a fee of %d, replacing pool transactions requires at least %d", tx.Hash, fee, required)
+	}
+
+	return replaced, nil
+}
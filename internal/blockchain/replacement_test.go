@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplacementEvictsConflictAndDescendants(t *testing.T) {
+	alice, bob, carol := newTestKey(t), newTestKey(t), newTestKey(t)
+	utxos, _, pool := fundedPool(t, alice, 1)
+
+	original := payment(t, utxos[0], alice, bob, 50, 1)
+	if err := pool.AddTransaction(*original); err != nil {
+		t.Fatal(err)
+	}
+	output, _ := original.GetUTXO(0)
+	child := payment(t, output, bob, carol, 40, 1)
+	if err := pool.AddTransaction(*child); err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := payment(t, utxos[0], alice, carol, 50, 10)
+	if err := pool.AddTransaction(*replacement); err != nil {
+		t.Fatal(err)
+	}
+	if pool.HasTransaction(original.Hash) || pool.HasTransaction(child.Hash) || !pool.HasTransaction(replacement.Hash) {
+		t.Fatal("replacement did not evict the conflicting transaction and its child")
+	}
+	if pool.spent[utxos[0].OutPoint()] != replacement.Hash {
+		t.Fatal("spent outpoint not taken over by the replacement")
+	}
+}
+
+func TestReplacementRules(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, _, pool := fundedPool(t, alice, 2)
+	original := payment(t, utxos[0], alice, bob, 10, 5)
+	if err := pool.AddTransaction(*original); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("lower fee rate", func(t *testing.T) {
+		if err := pool.AddTransaction(*payment(t, utxos[0], alice, bob, 20, 5)); err == nil {
+			t.Fatal("replacement paying the same fee accepted")
+		}
+	})
+
+	t.Run("spends replaced output", func(t *testing.T) {
+		// The change of the original goes back to alice
+		change, _ := original.GetUTXO(1)
+		tx, err := NewTransaction([]UTXO{utxos[0], change}, alice.pub, bob.pub, 10, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Sign(alice.priv); err != nil {
+			t.Fatal(err)
+		}
+		if err := pool.AddTransaction(*tx); err == nil || !strings.Contains(err.Error(), "spends an output") {
+			t.Fatalf("replacement spending an output of the transaction it replaces: %v", err)
+		}
+	})
+
+	t.Run("incremental fee", func(t *testing.T) {
+		defer func(rate int64) { IncrementalFeeRate = rate }(IncrementalFeeRate)
+		IncrementalFeeRate = 100
+
+		// A higher fee rate alone is not enough, the replacement has to pay
+		// for its own size on top of the fees it evicts
+		low := payment(t, utxos[0], alice, bob, 10, 6)
+		if ReplacementFeeBump(low.Size()) <= 1 {
+			t.Fatalf("bump of %d too small for the test", ReplacementFeeBump(low.Size()))
+		}
+		err := pool.AddTransaction(*low)
+		if err == nil || !strings.Contains(err.Error(), "requires at least") {
+			t.Fatalf("replacement without the incremental fee: %v", err)
+		}
+
+		// Leave room for the size to grow with the fee digits
+		fee := original.Fee() + ReplacementFeeBump(low.Size()+8)
+		enough := payment(t, utxos[0], alice, bob, 10, fee)
+		if err := pool.AddTransaction(*enough); err != nil {
+			t.Fatal(err)
+		}
+		if pool.HasTransaction(original.Hash) {
+			t.Fatal("original still pooled")
+		}
+	})
+}
+
+func TestReplacementLimitsEvictions(t *testing.T) {
+	defer func(max int) { MaxReplacements = max }(MaxReplacements)
+	MaxReplacements = 1
+
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, _, pool := fundedPool(t, alice, 2)
+	first := payment(t, utxos[0], alice, bob, 10, 1)
+	second := payment(t, utxos[1], alice, bob, 10, 1)
+	for _, tx := range []*Transaction{first, second} {
+		if err := pool.AddTransaction(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := NewTransaction(utxos, alice.pub, bob.pub, 10, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Sign(alice.priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.AddTransaction(*tx); err == nil {
+		t.Fatal("replacement of more than MaxReplacements transactions accepted")
+	}
+	if !pool.HasTransaction(first.Hash) || !pool.HasTransaction(second.Hash) {
+		t.Fatal("rejected replacement evicted pool transactions")
+	}
+}
+
+func TestReplacementRejectedByFullPoolRestoresOriginals(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, _, pool := fundedPool(t, alice, 3)
+	original := payment(t, utxos[0], alice, bob, 10, 1)
+	other := payment(t, utxos[1], alice, bob, 10, 50)
+	for _, tx := range []*Transaction{original, other} {
+		if err := pool.AddTransaction(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.MaxSize = original.Size() + other.Size()
+	size := pool.size
+
+	// Its second input makes the replacement too large for the pool, and its
+	// fee rate is the lowest once the original is gone
+	replacement, err := NewTransaction([]UTXO{utxos[0], utxos[2]}, alice.pub, bob.pub, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replacement.Sign(alice.priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.AddTransaction(*replacement); err == nil {
+		t.Fatal("replacement accepted into a full pool")
+	}
+	if pool.HasTransaction(replacement.Hash) || !pool.HasTransaction(original.Hash) || !pool.HasTransaction(other.Hash) {
+		t.Fatal("pool not restored after rejecting the replacement")
+	}
+	if pool.size != size || pool.spent[utxos[0].OutPoint()] != original.Hash || pool.spent[utxos[2].OutPoint()] != "" {
+		t.Fatal("pool accounting not restored after rejecting the replacement")
+	}
+}
@@ -0,0 +1,190 @@
+package blockchain
+
+import (
+	"fmt"
+	"nakamoto-blockchain/internal/crypto"
+	"nakamoto-blockchain/logger"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	snapshotInterval   = 100 // blocks between automatic snapshots
+	snapshotsKept      = 3
+	snapshotNameFormat = "snapshot-%08d.dat"
+	legacySnapshotGlob = "snapshot-*.json" // JSON snapshots written before the canonical encoding
+)
+
+// UTXOSnapshot is the full UTXO set as it was right after the block BlockHash at
+// Height was applied.
+type UTXOSnapshot struct {
+	Height          int
+	BlockHash       string
+	UTXOs           []UTXO
+	CoinbaseHeights map[string]int // needed to enforce coinbase maturity
+	Checksum        string
+}
+
+func NewUTXOSnapshot(height int, blockHash string, utxoSet *UTXOSet) *UTXOSnapshot {
+	snapshot := &UTXOSnapshot{
+		Height:          height,
+		BlockHash:       blockHash,
+		UTXOs:           utxoSet.All(),
+		CoinbaseHeights: make(map[string]int),
+	}
+	for txID, coinbaseHeight := range utxoSet.coinbaseHeights {
+		snapshot.CoinbaseHeights[txID] = coinbaseHeight
+	}
+	snapshot.Checksum = snapshot.CalculateChecksum()
+	return snapshot
+}
+
+func (s *UTXOSnapshot) CalculateChecksum() string {
+	return crypto.HashBytes(encodeSnapshot(s))
+}
+
+func (s *UTXOSnapshot) Verify() bool {
+	return s.CalculateChecksum() == s.Checksum
+}
+
+// UTXOSet rebuilds the UTXO set captured by the snapshot.
+func (s *UTXOSnapshot) UTXOSet() *UTXOSet {
+	utxoSet := NewUTXOSet()
+	for _, utxo := range s.UTXOs {
+		utxoSet.AddUTXO(utxo)
+	}
+	for txID, coinbaseHeight := range s.CoinbaseHeights {
+		utxoSet.coinbaseHeights[txID] = coinbaseHeight
+	}
+	utxoSet.height = s.Height
+	return utxoSet
+}
+
+// SnapshotStore keeps UTXO snapshots as one file per snapshot height, holding
+// the canonical encoding of the snapshot followed by its checksum. Legacy JSON
+// snapshots are ignored, as the chain state can always be rebuilt from the
+// blocks, and removed by Prune.
+type SnapshotStore struct {
+	dir string
+}
+
+func OpenSnapshotStore(dir string) (*SnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+	return &SnapshotStore{dir: dir}, nil
+}
+
+func (s *SnapshotStore) path(height int) string {
+	return filepath.Join(s.dir, fmt.Sprintf(snapshotNameFormat, height))
+}
+
+// Heights lists the heights of all stored snapshots, newest first.
+func (s *SnapshotStore) Heights() ([]int, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "snapshot-*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	var heights []int
+	for _, match := range matches {
+		var height int
+		if _, err := fmt.Sscanf(filepath.Base(match), snapshotNameFormat, &height); err == nil {
+			heights = append(heights, height)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(heights)))
+	return heights, nil
+}
+
+// Save writes the snapshot atomically, so a crash never leaves a partial file
+// under a valid snapshot name.
+func (s *SnapshotStore) Save(snapshot *UTXOSnapshot) error {
+	e := encoder{buf: encodeSnapshot(snapshot)}
+	e.string(snapshot.Checksum)
+	data := e.buf
+
+	tmpPath := s.path(snapshot.Height) + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path(snapshot.Height))
+}
+
+func (s *SnapshotStore) Load(height int) (*UTXOSnapshot, error) {
+	data, err := os.ReadFile(s.path(height))
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot at height %d: %v", height, err)
+	}
+	if snapshot.Height != height {
+		return nil, fmt.Errorf("snapshot file for height %d contains height %d", height, snapshot.Height)
+	}
+	return snapshot, nil
+}
+
+// Prune removes all but the newest keep snapshots, and any legacy snapshot.
+func (s *SnapshotStore) Prune(keep int) error {
+	legacy, err := filepath.Glob(filepath.Join(s.dir, legacySnapshotGlob))
+	if err != nil {
+		return err
+	}
+	for _, path := range legacy {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	heights, err := s.Heights()
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(heights); i++ {
+		if err := os.Remove(s.path(heights[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatestValid returns the newest snapshot whose checksum is intact and whose
+// block is part of the given chain, or nil if there is none.
+func (s *SnapshotStore) LatestValid(blocks []*Block) *UTXOSnapshot {
+	heights, err := s.Heights()
+	if err != nil {
+		return nil
+	}
+	for _, height := range heights {
+		if height >= len(blocks) {
+			continue
+		}
+		snapshot, err := s.Load(height)
+		if err != nil {
+			logger.WarnLogger.Printf("[Snapshot] Skipping snapshot at height %d: %v", height, err)
+			continue
+		}
+		if !snapshot.Verify() {
+			logger.WarnLogger.Printf("[Snapshot] Skipping snapshot at height %d: checksum mismatch", height)
+			continue
+		}
+		if blocks[height].Hash == snapshot.BlockHash {
+			return snapshot
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package blockchain
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotSaveLoadRoundTrip(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxoSet := NewUTXOSet()
+	utxoSet.AddUTXO(UTXO{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr})
+	utxoSet.AddUTXO(UTXO{TxID: "aa", Index: 1, Amount: 5, Address: bob.addr, LockTime: 7})
+	utxoSet.coinbaseHeights["aa"] = 3
+
+	snapshots, err := OpenSnapshotStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := NewUTXOSnapshot(3, "block3", utxoSet)
+	if err := snapshots.Save(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := snapshots.Load(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Verify() || !reflect.DeepEqual(loaded, snapshot) {
+		t.Fatalf("loaded snapshot %+v, saved %+v", loaded, snapshot)
+	}
+	if restored := loaded.UTXOSet(); !reflect.DeepEqual(restored.All(), utxoSet.All()) || restored.coinbaseHeights["aa"] != 3 || restored.Height() != 3 {
+		t.Fatal("snapshot does not restore the UTXO set")
+	}
+}
+
+func TestLatestValidSkipsCorruptAndForeignSnapshots(t *testing.T) {
+	var blocks []*Block
+	for height := 0; height < 4; height++ {
+		blocks = append(blocks, storedBlock(height))
+	}
+	snapshots, err := OpenSnapshotStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := 1; height <= 2; height++ {
+		if err := snapshots.Save(NewUTXOSnapshot(height, blocks[height].Hash, NewUTXOSet())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A snapshot of a block that is not on the chain, say of a stale branch
+	if err := snapshots.Save(NewUTXOSnapshot(3, "stale", NewUTXOSet())); err != nil {
+		t.Fatal(err)
+	}
+
+	// The checksum is stored last
+	data, err := os.ReadFile(snapshots.path(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(snapshots.path(2), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := snapshots.LatestValid(blocks)
+	if snapshot == nil || snapshot.Height != 1 {
+		t.Fatalf("latest valid snapshot %+v, want the one at height 1", snapshot)
+	}
+}
+
+func TestOpenBlockchainReplaysFromSnapshot(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	initial := []UTXO{{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}}
+	dir := t.TempDir()
+	store, err := OpenFileBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := OpenSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := OpenBlockchain(initial, store, snapshots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineOnTip(t, bc)
+	if _, err := bc.SaveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	mineOnTip(t, bc, *payment(t, initial[0], alice, bob, 30, 1))
+	store.Close()
+
+	// A torn write after the last block
+	file, err := os.OpenFile(store.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 1})
+	file.Close()
+
+	reopen := func(snapshots *SnapshotStore) *Blockchain {
+		t.Helper()
+		store, err := OpenFileBlockStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		reopened, err := OpenBlockchain(initial, store, snapshots)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reopened
+	}
+	if snapshot := snapshots.LatestValid(bc.Blocks); snapshot == nil || snapshot.Height != 1 {
+		t.Fatal("snapshot at height 1 not usable")
+	}
+	fromSnapshot, fullReplay := reopen(snapshots), reopen(nil)
+
+	if fromSnapshot.GetLastBlock().Hash != bc.GetLastBlock().Hash {
+		t.Fatal("reopened chain has another tip")
+	}
+	for _, reopened := range []*Blockchain{fromSnapshot, fullReplay} {
+		if !reflect.DeepEqual(reopened.UTXOSet.All(), bc.UTXOSet.All()) {
+			t.Fatal("reopened UTXO set differs from the original")
+		}
+	}
+	if fromSnapshot.UTXOSet.Balance(bob.addr) != 30 || fromSnapshot.UTXOSet.Balance(alice.addr) != 69 {
+		t.Fatal("payment after the snapshot not replayed")
+	}
+}
@@ -0,0 +1,310 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"nakamoto-blockchain/logger"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// BlockStore persists the main chain so a miner can recover it after a restart.
+// Blocks are always stored in height order, starting with the genesis block.
+type BlockStore interface {
+	// Append durably writes a block that extends the stored chain by one.
+	Append(block *Block) error
+	// Truncate drops every stored block above the given height.
+	Truncate(height int) error
+	// Load returns the stored chain ordered by height.
+	Load() ([]*Block, error)
+	Close() error
+}
+
+const (
+	segmentBlocks     = 1000 // blocks per segment file
+	recordHeaderSize  = 8    // 4 byte payload length + 4 byte CRC32
+	segmentNameFormat = "blocks-%06d.dat"
+)
+
+// FileBlockStore keeps the chain in append-only segment files. Segment n holds
+// the blocks with heights [n*segmentBlocks, (n+1)*segmentBlocks), each one as a
+// length and checksum prefixed record, so a torn write at the tail is detected
+// and discarded on the next Load.
+type FileBlockStore struct {
+	mu      sync.Mutex
+	dir     string
+	offsets []int64 // offset of each stored height within its segment
+	file    *os.File
+	fileSeg int
+}
+
+func OpenFileBlockStore(dir string) (*FileBlockStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create block store directory: %v", err)
+	}
+	return &FileBlockStore{dir: dir, fileSeg: -1}, nil
+}
+
+func (s *FileBlockStore) segmentPath(segment int) string {
+	return filepath.Join(s.dir, fmt.Sprintf(segmentNameFormat, segment))
+}
+
+func (s *FileBlockStore) segments() ([]int, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "blocks-*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, match := range matches {
+		var segment int
+		if _, err := fmt.Sscanf(filepath.Base(match), segmentNameFormat, &segment); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (s *FileBlockStore) Load() ([]*Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeFile()
+	s.offsets = nil
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*Block
+	for i, segment := range segments {
+		if segment != i {
+			return nil, fmt.Errorf("block store segment %d is missing", i)
+		}
+
+		data, err := os.ReadFile(s.segmentPath(segment))
+		if err != nil {
+			return nil, err
+		}
+
+		var offset int64
+		for offset < int64(len(data)) {
+			block, size, err := decodeRecord(data[offset:])
+			if err != nil {
+				if i != len(segments)-1 {
+					return nil, fmt.Errorf("corrupted record in block store segment %d: %v", segment, err)
+				}
+				// Only the tail of the newest segment can be partially written
+				logger.WarnLogger.Printf("[BlockStore] Discarding torn record in segment %d at offset %d: %v", segment, offset, err)
+				if err := os.Truncate(s.segmentPath(segment), offset); err != nil {
+					return nil, err
+				}
+				break
+			}
+
+			if block.Header.Height != len(blocks) {
+				return nil, fmt.Errorf("block store out of order: expected height %d, found %d", len(blocks), block.Header.Height)
+			}
+			blocks = append(blocks, block)
+			s.offsets = append(s.offsets, offset)
+			offset += size
+		}
+	}
+
+	return blocks, nil
+}
+
+func (s *FileBlockStore) Append(block *Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	height := len(s.offsets)
+	if block.Header.Height != height {
+		return fmt.Errorf("cannot append block at height %d to store with %d blocks", block.Header.Height, height)
+	}
+
+	record, err := encodeRecord(block)
+	if err != nil {
+		return err
+	}
+
+	segment := height / segmentBlocks
+	if s.fileSeg != segment {
+		s.closeFile()
+		file, err := os.OpenFile(s.segmentPath(segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.file = file
+		s.fileSeg = segment
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(record); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.offsets = append(s.offsets, info.Size())
+	return nil
+}
+
+func (s *FileBlockStore) Truncate(height int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if height < -1 {
+		return fmt.Errorf("invalid truncate height %d", height)
+	}
+	if height+1 >= len(s.offsets) {
+		return nil
+	}
+
+	s.closeFile()
+
+	first := height + 1
+	segment := first / segmentBlocks
+	if err := os.Truncate(s.segmentPath(segment), s.offsets[first]); err != nil {
+		return err
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if seg > segment {
+			if err := os.Remove(s.segmentPath(seg)); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.offsets = s.offsets[:first]
+	return nil
+}
+
+func (s *FileBlockStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFile()
+}
+
+func (s *FileBlockStore) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	s.fileSeg = -1
+	return err
+}
+
+// Migrate rewrites every record still stored as JSON, as written before the
+// canonical encoding, in the canonical encoding. Each segment is replaced
+// atomically, so an interrupted migration can simply be run again. It returns
+// the number of rewritten blocks.
+func (s *FileBlockStore) Migrate() (int, error) {
+	blocks, err := s.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	migrated := 0
+	for first := 0; first < len(blocks); first += segmentBlocks {
+		segment := first / segmentBlocks
+		data, err := os.ReadFile(s.segmentPath(segment))
+		if err != nil {
+			return migrated, err
+		}
+
+		var rewritten []byte
+		var offsets []int64
+		legacy := 0
+		for height := first; height < len(blocks) && height < first+segmentBlocks; height++ {
+			if isLegacyRecord(data[s.offsets[height]:]) {
+				legacy++
+			}
+			record, err := encodeRecord(blocks[height])
+			if err != nil {
+				return migrated, err
+			}
+			offsets = append(offsets, int64(len(rewritten)))
+			rewritten = append(rewritten, record...)
+		}
+		if legacy == 0 {
+			continue
+		}
+
+		tmpPath := s.segmentPath(segment) + ".tmp"
+		if err := os.WriteFile(tmpPath, rewritten, 0644); err != nil {
+			return migrated, err
+		}
+		if err := os.Rename(tmpPath, s.segmentPath(segment)); err != nil {
+			return migrated, err
+		}
+		copy(s.offsets[first:], offsets)
+		migrated += legacy
+	}
+	return migrated, nil
+}
+
+func encodeRecord(block *Block) ([]byte, error) {
+	payload := encodeBlock(block)
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+	return record, nil
+}
+
+func decodeRecord(data []byte) (*Block, int64, error) {
+	if len(data) < recordHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	length := int64(binary.BigEndian.Uint32(data[0:4]))
+	checksum := binary.BigEndian.Uint32(data[4:8])
+	if int64(len(data)) < recordHeaderSize+length {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := data[recordHeaderSize : recordHeaderSize+length]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+
+	if isLegacyRecord(data) {
+		var block Block
+		if err := json.Unmarshal(payload, &block); err != nil {
+			return nil, 0, err
+		}
+		return &block, recordHeaderSize + length, nil
+	}
+
+	block, err := decodeBlock(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return block, recordHeaderSize + length, nil
+}
+
+// isLegacyRecord reports whether the record starting data holds a JSON block.
+// Canonical payloads start with a version byte, never with '{'.
+func isLegacyRecord(data []byte) bool {
+	return len(data) > recordHeaderSize && data[recordHeaderSize] == '{'
+}
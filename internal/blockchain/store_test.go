@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// storedBlock returns a block good enough for the store, which only checks
+// heights.
+func storedBlock(height int) *Block {
+	return &Block{Header: BlockHeader{Version: CanonicalEncoding, Height: height}, Hash: fmt.Sprint("block", height)}
+}
+
+func openStore(t *testing.T, dir string) (*FileBlockStore, []*Block) {
+	t.Helper()
+	store, err := OpenFileBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, blocks
+}
+
+func appendBlocks(t *testing.T, store *FileBlockStore, from, to int) {
+	t.Helper()
+	for height := from; height < to; height++ {
+		if err := store.Append(storedBlock(height)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStoreDiscardsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openStore(t, dir)
+	appendBlocks(t, store, 0, 3)
+	store.Close()
+
+	path := store.segmentPath(0)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _ := encodeRecord(storedBlock(3))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(record[:len(record)/2])
+	file.Close()
+
+	store, blocks := openStore(t, dir)
+	if len(blocks) != 3 {
+		t.Fatalf("%d blocks loaded, want 3", len(blocks))
+	}
+	if truncated, _ := os.Stat(path); truncated.Size() != info.Size() {
+		t.Fatalf("segment is %d bytes after discarding the torn record, want %d", truncated.Size(), info.Size())
+	}
+
+	appendBlocks(t, store, 3, 5)
+	store.Close()
+	store, blocks = openStore(t, dir)
+	defer store.Close()
+	if len(blocks) != 5 || blocks[3].Hash != storedBlock(3).Hash || blocks[4].Hash != storedBlock(4).Hash {
+		t.Fatalf("%d blocks loaded after appending past the torn record, want 5", len(blocks))
+	}
+}
+
+func TestStoreTruncatesAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openStore(t, dir)
+	appendBlocks(t, store, 0, 2*segmentBlocks+10)
+
+	height := segmentBlocks - 5
+	if err := store.Truncate(height); err != nil {
+		t.Fatal(err)
+	}
+	for _, segment := range []int{1, 2} {
+		if _, err := os.Stat(store.segmentPath(segment)); !os.IsNotExist(err) {
+			t.Fatalf("segment %d kept after truncating to height %d", segment, height)
+		}
+	}
+
+	appendBlocks(t, store, height+1, segmentBlocks+1)
+	store.Close()
+	store, blocks := openStore(t, dir)
+	defer store.Close()
+	if len(blocks) != segmentBlocks+1 {
+		t.Fatalf("%d blocks loaded, want %d", len(blocks), segmentBlocks+1)
+	}
+	for i, block := range blocks {
+		if block.Hash != storedBlock(i).Hash {
+			t.Fatalf("block %d is %s", i, block.Hash)
+		}
+	}
+}
@@ -2,49 +2,110 @@ package blockchain
 
 import (
 	"errors"
+	"math"
 	"nakamoto-blockchain/internal/crypto"
+	"nakamoto-blockchain/internal/script"
 	"nakamoto-blockchain/logger"
 	"time"
 )
 
 type TransactionContent struct {
+	Version      int `json:",omitempty"` // encoding version, see EncodingVersion
 	InputUTXOs   []UTXO
 	OutputUTXOs  []UTXO
 	SenderPubKey string
 	Timestamp    int64
+	Height       int   `json:",omitempty"` // block height, only set on coinbase transactions
+	LockTime     int64 `json:",omitempty"` // block height or time before which the transaction cannot be mined, see LockTimeThreshold
 }
 
 type Transaction struct {
 	Content   TransactionContent
 	Signature string
 	Hash      string
+	Witnesses []InputWitness `json:",omitempty"` // one per input, used instead of SenderPubKey and Signature
 }
 
-func NewTransaction(InputUTXOs []UTXO, SenderPubKey, ReceiverPublicKey string, Amount int64) (*Transaction, error) {
+// InputWitness proves that the owner of an input authorised the transaction:
+// Signature signs the transaction's sighash with the key whose address owns
+// the input. Inputs with a locking script are unlocked by UnlockScript instead.
+type InputWitness struct {
+	PubKey       string
+	Signature    string
+	UnlockScript string `json:",omitempty"`
+}
+
+// MaxTransactionOutputs is the largest number of outputs a transaction may have.
+var MaxTransactionOutputs = 100
+
+// Payment is one output of a transaction being built.
+type Payment struct {
+	Address    string
+	Amount     int64
+	LockScript string // optional, see NewScriptPayment
+	LockTime   int64  // optional, block height or time before which the output cannot be spent
+}
+
+// NewScriptPayment pays amount to an output locked by lockScript instead of a
+// plain address.
+func NewScriptPayment(lockScript string, amount int64) (Payment, error) {
+	if err := script.Validate(lockScript); err != nil {
+		return Payment{}, err
+	}
+	return Payment{Address: script.Address(lockScript), Amount: amount, LockScript: lockScript}, nil
+}
+
+// NewTransaction pays Amount to the receiver and Fee to the miner, returning
+// the rest of the inputs to the sender.
+func NewTransaction(InputUTXOs []UTXO, SenderPubKey, ReceiverPublicKey string, Amount, Fee int64) (*Transaction, error) {
+	return NewBatchTransaction(InputUTXOs, SenderPubKey, []Payment{{Address: crypto.Key2Addr(ReceiverPublicKey), Amount: Amount}}, Fee)
+}
+
+// NewBatchTransaction pays every payment, in order, and Fee to the miner. The
+// rest of the inputs is returned to the sender in a final change output.
+func NewBatchTransaction(InputUTXOs []UTXO, SenderPubKey string, Payments []Payment, Fee int64) (*Transaction, error) {
 	var totalInput int64
 	for _, utxo := range InputUTXOs {
 		totalInput += utxo.Amount
 	}
 
+	if Fee < 0 {
+		return nil, errors.New("fee cannot be negative")
+	}
+	if len(Payments) == 0 {
+		return nil, errors.New("transaction has no payments")
+	}
+
 	var outputUTXOs []UTXO
-	outputUTXOs = append(outputUTXOs, UTXO{
-		TxID:    "",
-		Index:   0,
-		Amount:  Amount,
-		Address: crypto.Key2Addr(ReceiverPublicKey),
-	})
-
-	leftoverAmount := totalInput - Amount
+	totalOutput := Fee
+	for i, payment := range Payments {
+		outputUTXOs = append(outputUTXOs, UTXO{
+			TxID:       "",
+			Index:      i,
+			Amount:     payment.Amount,
+			Address:    payment.Address,
+			LockScript: payment.LockScript,
+			LockTime:   payment.LockTime,
+		})
+		totalOutput += payment.Amount
+	}
+
+	if totalInput < totalOutput {
+		return nil, errors.New("inputs do not cover payments and fee")
+	}
+
+	leftoverAmount := totalInput - totalOutput
 	if leftoverAmount > 0 {
 		outputUTXOs = append(outputUTXOs, UTXO{
 			TxID:    "",
-			Index:   1,
+			Index:   len(outputUTXOs),
 			Amount:  leftoverAmount,
 			Address: crypto.Key2Addr(SenderPubKey),
 		})
 	}
 
 	txContent := TransactionContent{
+		Version:      EncodingVersion,
 		InputUTXOs:   InputUTXOs,
 		OutputUTXOs:  outputUTXOs,
 		SenderPubKey: SenderPubKey,
@@ -62,6 +123,156 @@ func NewTransaction(InputUTXOs []UTXO, SenderPubKey, ReceiverPublicKey string, A
 	return tx, nil
 }
 
+// NewMultiSenderTransaction builds a transaction spending inputs that may be
+// owned by different keys, such as a coin-join. Each owner signs their inputs
+// with SignInput or SignInputs. As there is no single sender to return change
+// to, the payments and the fee must add up to the inputs.
+func NewMultiSenderTransaction(InputUTXOs []UTXO, Payments []Payment, Fee int64) (*Transaction, error) {
+	var totalInput, totalOutput int64
+	for _, utxo := range InputUTXOs {
+		totalInput += utxo.Amount
+	}
+
+	outputUTXOs := []UTXO{}
+	for i, payment := range Payments {
+		outputUTXOs = append(outputUTXOs, UTXO{
+			TxID:       "",
+			Index:      i,
+			Amount:     payment.Amount,
+			Address:    payment.Address,
+			LockScript: payment.LockScript,
+			LockTime:   payment.LockTime,
+		})
+		totalOutput += payment.Amount
+	}
+
+	if Fee < 0 || totalInput != totalOutput+Fee {
+		return nil, errors.New("payments and fee must add up to the inputs")
+	}
+
+	tx := &Transaction{
+		Content: TransactionContent{
+			Version:     EncodingVersion,
+			InputUTXOs:  InputUTXOs,
+			OutputUTXOs: outputUTXOs,
+			Timestamp:   time.Now().UnixMilli(),
+		},
+		Witnesses: make([]InputWitness, len(InputUTXOs)),
+	}
+
+	if !tx.VerifyContent() {
+		return nil, errors.New("transaction content verification failed")
+	}
+
+	hash, err := tx.SigHash()
+	if err != nil {
+		return nil, err
+	}
+	tx.Hash = hash
+	return tx, nil
+}
+
+// SigHash is the hash signed by every input witness. It covers the whole
+// content but no signatures, so inputs can be signed independently, and it is
+// also the hash of transactions using witnesses.
+func (tx *Transaction) SigHash() (string, error) {
+	if tx.Content.Version == LegacyEncoding {
+		return crypto.Hash(tx.Content)
+	}
+	return crypto.HashBytes(tx.Content.Encode()), nil
+}
+
+// CalculateHash returns the hash identifying tx, which its sender signs. From
+// CanonicalEncoding on it is the SigHash of every kind of transaction. Legacy
+// transactions without witnesses hash the whole transaction but its signature
+// and hash.
+func (tx *Transaction) CalculateHash() (string, error) {
+	if tx.Content.Version != LegacyEncoding || len(tx.Witnesses) > 0 {
+		return tx.SigHash()
+	}
+	unhashed := *tx
+	unhashed.Signature = ""
+	unhashed.Hash = ""
+	return crypto.Hash(unhashed)
+}
+
+// SignInput signs the input at index with privateKey. Inputs locked by a
+// script other than pay-to-pubkey-hash need SetUnlockScript instead.
+func (tx *Transaction) SignInput(index int, privateKey string) error {
+	if index < 0 || index >= len(tx.Witnesses) {
+		return errors.New("invalid input index")
+	}
+
+	pubKey, err := crypto.PublicKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	lockScript := tx.Content.InputUTXOs[index].LockScript
+	if lockScript != "" && lockScript != script.PayToPubKeyHash(crypto.Key2Addr(pubKey)) {
+		return errors.New("input is not locked to this key")
+	}
+
+	sigHash, err := tx.SigHash()
+	if err != nil {
+		return err
+	}
+
+	signature, err := crypto.Sign(sigHash, privateKey)
+	if err != nil {
+		return err
+	}
+
+	if lockScript != "" {
+		tx.Witnesses[index] = InputWitness{UnlockScript: script.PayToPubKeyHashUnlock(signature, pubKey)}
+	} else {
+		tx.Witnesses[index] = InputWitness{PubKey: pubKey, Signature: signature}
+	}
+	tx.Hash = sigHash
+	return nil
+}
+
+// SetUnlockScript sets the script unlocking the input at index, such as a
+// script.MultisigUnlock of signatures of the transaction's SigHash.
+func (tx *Transaction) SetUnlockScript(index int, unlockScript string) error {
+	if index < 0 || index >= len(tx.Witnesses) {
+		return errors.New("invalid input index")
+	}
+	if tx.Content.InputUTXOs[index].LockScript == "" {
+		return errors.New("input has no locking script")
+	}
+
+	sigHash, err := tx.SigHash()
+	if err != nil {
+		return err
+	}
+
+	tx.Witnesses[index] = InputWitness{UnlockScript: unlockScript}
+	tx.Hash = sigHash
+	return nil
+}
+
+// SignInputs signs every input owned by privateKey and returns how many it signed.
+func (tx *Transaction) SignInputs(privateKey string) (int, error) {
+	pubKey, err := crypto.PublicKey(privateKey)
+	if err != nil {
+		return 0, err
+	}
+
+	address := crypto.Key2Addr(pubKey)
+	signed := 0
+	for i, utxo := range tx.Content.InputUTXOs {
+		if utxo.Address != address {
+			continue
+		}
+		if err := tx.SignInput(i, privateKey); err != nil {
+			return signed, err
+		}
+		signed++
+	}
+	return signed, nil
+}
+
 func (tx *Transaction) GetUTXO(Index int) (UTXO, error) {
 	if Index < 0 || Index >= len(tx.Content.OutputUTXOs) {
 		return UTXO{}, errors.New("invalid UTXO index")
@@ -73,7 +284,7 @@ func (tx *Transaction) GetUTXO(Index int) (UTXO, error) {
 }
 
 func (tx *Transaction) Sign(privateKey string) error {
-	txHash, err := crypto.Hash(tx)
+	txHash, err := tx.CalculateHash()
 	if err != nil {
 		return err
 	}
@@ -88,15 +299,81 @@ func (tx *Transaction) Sign(privateKey string) error {
 }
 
 func (tx *Transaction) VerifySignature() bool {
+	if len(tx.Witnesses) > 0 {
+		return tx.verifyWitnesses()
+	}
+
+	hash, err := tx.CalculateHash()
+	if err != nil || hash != tx.Hash {
+		logger.WarnLogger.Printf("Transaction %s hash does not match its content", tx.Hash)
+		return false
+	}
+
 	valid, err := crypto.VerifySignature(tx.Hash, tx.Signature, tx.Content.SenderPubKey)
 	return err == nil && valid
 }
 
+// verifyWitnesses checks that every input is signed by the key owning it.
+func (tx *Transaction) verifyWitnesses() bool {
+	if len(tx.Witnesses) != len(tx.Content.InputUTXOs) || tx.Content.SenderPubKey != "" || tx.Signature != "" {
+		logger.WarnLogger.Printf("Transaction %s mixes input witnesses with a sender signature", tx.Hash)
+		return false
+	}
+
+	sigHash, err := tx.SigHash()
+	if err != nil || sigHash != tx.Hash {
+		logger.WarnLogger.Printf("Transaction %s hash does not match its content", tx.Hash)
+		return false
+	}
+
+	for i, witness := range tx.Witnesses {
+		if lockScript := tx.Content.InputUTXOs[i].LockScript; lockScript != "" {
+			if witness.PubKey != "" || witness.Signature != "" {
+				logger.WarnLogger.Printf("Input %d of transaction %s mixes a script with a signature", i, tx.Hash)
+				return false
+			}
+			if err := script.Execute(witness.UnlockScript, lockScript, sigHash); err != nil {
+				logger.WarnLogger.Printf("Input %d of transaction %s not unlocked: %v", i, tx.Hash, err)
+				return false
+			}
+			continue
+		}
+		if witness.UnlockScript != "" {
+			logger.WarnLogger.Printf("Input %d of transaction %s has an unlocking script but no locking script", i, tx.Hash)
+			return false
+		}
+
+		if crypto.Key2Addr(witness.PubKey) != tx.Content.InputUTXOs[i].Address {
+			logger.WarnLogger.Printf("Input %d of transaction %s is not signed by its owner", i, tx.Hash)
+			return false
+		}
+		valid, err := crypto.VerifySignature(sigHash, witness.Signature, witness.PubKey)
+		if err != nil || !valid {
+			logger.WarnLogger.Printf("Invalid signature for input %d of transaction %s", i, tx.Hash)
+			return false
+		}
+	}
+	return true
+}
+
 func (tx *Transaction) VerifyContent() bool {
-	var totalInput, totalOutput int64
+	if tx.IsCoinbase() || tx.Content.Height != 0 {
+		logger.WarnLogger.Println("Coinbase transaction outside of a block")
+		return false
+	}
+
+	if tx.Content.Version < LegacyEncoding || tx.Content.Version > CanonicalEncoding {
+		logger.WarnLogger.Printf("Unknown transaction version %d", tx.Content.Version)
+		return false
+	}
+
+	if tx.Content.LockTime < 0 {
+		logger.WarnLogger.Println("Negative transaction lock time")
+		return false
+	}
 
-	if len(tx.Content.OutputUTXOs) > 2 {
-		logger.WarnLogger.Println("Transaction has more than 2 output UTXOs")
+	if len(tx.Content.OutputUTXOs) > MaxTransactionOutputs {
+		logger.WarnLogger.Printf("Transaction has more than %d output UTXOs", MaxTransactionOutputs)
 		return false
 	}
 
@@ -105,24 +382,32 @@ func (tx *Transaction) VerifyContent() bool {
 			logger.WarnLogger.Println("Invalid input UTXO")
 			return false
 		}
-		totalInput += utxo.Amount
 	}
 
 	for i, utxo := range tx.Content.OutputUTXOs {
-		if utxo.Amount <= 0 || utxo.TxID != "" || utxo.Index != i {
+		if utxo.Amount <= 0 || utxo.TxID != "" || utxo.Index != i || utxo.LockTime < 0 || !utxo.validLockScript() {
 			logger.WarnLogger.Println("Invalid output UTXO")
 			return false
 		}
-		totalOutput += utxo.Amount
 	}
 
-	if totalInput != totalOutput {
-		logger.WarnLogger.Println("Total input amount does not match total output amount")
+	// Whatever the outputs leave over is the fee
+	if _, ok := tx.checkedFee(); !ok {
+		logger.WarnLogger.Println("Total output amount exceeds total input amount or overflows")
 		return false
 	}
 
+	// Inputs of transactions with witnesses are checked against their own keys
+	if len(tx.Witnesses) > 0 {
+		return true
+	}
+
 	senderAddress := crypto.Key2Addr(tx.Content.SenderPubKey)
 	for i, utxo := range tx.Content.InputUTXOs {
+		if utxo.LockScript != "" {
+			logger.WarnLogger.Printf("Input UTXO %d of transaction %s has a locking script but no witness", i, tx.Hash)
+			return false
+		}
 		if utxo.Address != senderAddress {
 			logger.WarnLogger.Printf("Input UTXO address mismatch in transaction %s (UTXO index %d): received %s, expected %s", 
 				tx.Hash, i, utxo.Address, senderAddress)
@@ -130,14 +415,64 @@ func (tx *Transaction) VerifyContent() bool {
 		}
 	}
 
-	if len(tx.Content.OutputUTXOs) > 1 && tx.Content.OutputUTXOs[1].Address != senderAddress {
-		logger.WarnLogger.Println("Leftover UTXO address does not match sender address")
-		return false
-	}
-
 	return true
 }
 
 func (tx *Transaction) Verify() bool {
 	return tx.VerifyContent() && tx.VerifySignature()
 }
+
+// sumAmounts returns the total amount of utxos, or false if an amount is not
+// positive or the total overflows.
+func sumAmounts(utxos []UTXO) (int64, bool) {
+	var total int64
+	for _, utxo := range utxos {
+		if utxo.Amount <= 0 || utxo.Amount > math.MaxInt64-total {
+			return 0, false
+		}
+		total += utxo.Amount
+	}
+	return total, true
+}
+
+// checkedFee returns the fee of tx, or false if its amounts are invalid or its
+// outputs are worth more than its inputs.
+func (tx *Transaction) checkedFee() (int64, bool) {
+	totalInput, ok := sumAmounts(tx.Content.InputUTXOs)
+	if !ok {
+		return 0, false
+	}
+	totalOutput, ok := sumAmounts(tx.Content.OutputUTXOs)
+	if !ok || totalOutput > totalInput {
+		return 0, false
+	}
+	return totalInput - totalOutput, true
+}
+
+// OutputAmount returns the sum of the amounts of the outputs of tx, which must
+// have been verified.
+func (tx *Transaction) OutputAmount() int64 {
+	var total int64
+	for _, utxo := range tx.Content.OutputUTXOs {
+		total += utxo.Amount
+	}
+	return total
+}
+
+// Size returns the length in bytes of the canonical encoding of tx, as it is
+// stored in a block.
+func (tx *Transaction) Size() int {
+	var e encoder
+	e.transaction(*tx)
+	return len(e.buf)
+}
+
+// Fee returns what the inputs of tx are worth beyond its outputs. Like
+// OutputAmount, it expects a verified transaction.
+func (tx *Transaction) Fee() int64 {
+	var totalInput int64
+	for _, utxo := range tx.Content.InputUTXOs {
+		totalInput += utxo.Amount
+	}
+	return totalInput - tx.OutputAmount()
+}
@@ -0,0 +1,198 @@
+package blockchain
+
+import (
+	"math"
+	"nakamoto-blockchain/internal/crypto"
+	"nakamoto-blockchain/internal/script"
+	"testing"
+)
+
+func TestVerifyRejectsOverflowingOutputs(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	input := UTXO{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}
+	utxoSet := NewUTXOSet()
+	utxoSet.AddUTXO(input)
+
+	// The outputs wrap around to 100, which would pass as a fee of 0
+	tx := payment(t, input, alice, bob, 10, 0)
+	tx.Content.OutputUTXOs = []UTXO{
+		{Index: 0, Amount: math.MaxInt64, Address: bob.addr},
+		{Index: 1, Amount: math.MaxInt64, Address: bob.addr},
+		{Index: 2, Amount: input.Amount + 2, Address: bob.addr},
+	}
+	if err := tx.Sign(alice.priv); err != nil {
+		t.Fatal(err)
+	}
+	if tx.Verify() {
+		t.Fatal("transaction with overflowing outputs verified")
+	}
+	if utxoSet.CheckTransaction(*tx) {
+		t.Fatal("transaction with overflowing outputs accepted by the UTXO set")
+	}
+}
+
+func TestVerifyRejectsNonPositiveAmounts(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	input := UTXO{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}
+	for _, amount := range []int64{0, -1} {
+		tx := payment(t, input, alice, bob, 10, 0)
+		tx.Content.OutputUTXOs[0].Amount = amount
+		if err := tx.Sign(alice.priv); err != nil {
+			t.Fatal(err)
+		}
+		if tx.Verify() {
+			t.Fatalf("output of %d accepted", amount)
+		}
+	}
+}
+
+func TestCoinbaseRejectsOverflowingOutputs(t *testing.T) {
+	coinbase := coinbase(t, 1)
+	coinbase.Content.OutputUTXOs = []UTXO{
+		{Index: 0, Amount: math.MaxInt64, Address: "miner"},
+		{Index: 1, Amount: math.MaxInt64, Address: "miner"},
+		{Index: 2, Amount: 2, Address: "miner"},
+	}
+	coinbase.Hash, _ = coinbase.CalculateHash()
+	if coinbase.VerifyCoinbase(1) {
+		t.Fatal("coinbase with overflowing outputs verified")
+	}
+
+	block := &Block{Header: BlockHeader{Height: 1}, Content: BlockContent{Transactions: []Transaction{coinbase}}}
+	if block.VerifyReward() {
+		t.Fatal("block reward check passed")
+	}
+	if err := NewUTXOSet().AddBlock(block); err == nil {
+		t.Fatal("block with overflowing coinbase applied")
+	}
+}
+
+func TestBlockRewardRejectsOverflowingFees(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	rich := payment(t, UTXO{TxID: "aa", Index: 0, Amount: math.MaxInt64, Address: alice.addr}, alice, bob, 1, math.MaxInt64-1)
+	block := &Block{Header: BlockHeader{Height: 1}, Content: BlockContent{Transactions: []Transaction{coinbase(t, 1), *rich, *rich}}}
+	if _, ok := block.Reward(); ok {
+		t.Fatal("overflowing fees summed")
+	}
+}
+
+func TestWitnessesSignEachInput(t *testing.T) {
+	alice, bob, carol := newTestKey(t), newTestKey(t), newTestKey(t)
+	inputs := []UTXO{
+		{TxID: "aa", Index: 0, Amount: 10, Address: alice.addr},
+		{TxID: "bb", Index: 0, Amount: 20, Address: bob.addr},
+	}
+	tx, err := NewMultiSenderTransaction(inputs, []Payment{{Address: carol.addr, Amount: 25}}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.SignInputs(alice.priv); err != nil {
+		t.Fatal(err)
+	}
+	if tx.Verify() {
+		t.Fatal("transaction verified with an unsigned input")
+	}
+	if _, err := tx.SignInputs(bob.priv); err != nil {
+		t.Fatal(err)
+	}
+	if !tx.Verify() {
+		t.Fatal("fully signed transaction rejected")
+	}
+
+	swapped := *tx
+	swapped.Witnesses = []InputWitness{tx.Witnesses[1], tx.Witnesses[0]}
+	if swapped.Verify() {
+		t.Fatal("witnesses of other inputs accepted")
+	}
+}
+
+// A plain address output must not be spendable by an unlocking script that
+// succeeds on its own.
+func TestVerifyRejectsUnlockScriptWithoutLockScript(t *testing.T) {
+	alice, mallory := newTestKey(t), newTestKey(t)
+	input := UTXO{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}
+	utxoSet := NewUTXOSet()
+	utxoSet.AddUTXO(input)
+
+	tx, err := NewMultiSenderTransaction([]UTXO{input}, []Payment{{Address: mallory.addr, Amount: 99}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Witnesses[0] = InputWitness{UnlockScript: "1"}
+	if tx.Hash, err = tx.SigHash(); err != nil {
+		t.Fatal(err)
+	}
+	if tx.Verify() {
+		t.Fatal("forged witness accepted")
+	}
+	if utxoSet.CheckTransaction(*tx) {
+		t.Fatal("forged witness accepted by the UTXO set")
+	}
+}
+
+func TestScriptLockedOutputs(t *testing.T) {
+	alice, bob, carol, dave := newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t)
+	input := UTXO{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}
+	utxoSet := NewUTXOSet()
+	utxoSet.AddUTXO(input)
+
+	multisig, err := script.Multisig(2, []string{alice.pub, bob.pub, carol.pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	multisigPayment, err := NewScriptPayment(multisig, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyHashPayment, err := NewScriptPayment(script.PayToPubKeyHash(dave.addr), 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funding, err := NewBatchTransaction([]UTXO{input}, alice.pub, []Payment{multisigPayment, pubKeyHashPayment}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := funding.Sign(alice.priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := utxoSet.AddTransaction(*funding); err != nil {
+		t.Fatal(err)
+	}
+	multisigOutput, _ := funding.GetUTXO(0)
+	pubKeyHashOutput, _ := funding.GetUTXO(1)
+
+	spend, err := NewMultiSenderTransaction([]UTXO{multisigOutput, pubKeyHashOutput}, []Payment{{Address: alice.addr, Amount: 88}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spend.SignInputs(dave.priv); err != nil {
+		t.Fatal(err)
+	}
+	sigHash, _ := spend.SigHash()
+	aliceSig, _ := crypto.Sign(sigHash, alice.priv)
+	carolSig, _ := crypto.Sign(sigHash, carol.priv)
+
+	for name, unlock := range map[string]string{
+		"wrong order":      script.MultisigUnlock([]string{carolSig, aliceSig}),
+		"too few":          script.MultisigUnlock([]string{aliceSig}),
+		"opcode in unlock": "OP_DUP " + aliceSig,
+	} {
+		spend.SetUnlockScript(0, unlock)
+		if spend.Verify() {
+			t.Fatalf("%s: multisig input unlocked", name)
+		}
+	}
+
+	spend.SetUnlockScript(0, script.MultisigUnlock([]string{aliceSig, carolSig}))
+	if !spend.Verify() || !utxoSet.CheckTransaction(*spend) {
+		t.Fatal("valid script spend rejected")
+	}
+
+	// Inputs are checked against the UTXO set, lock script included
+	forged := *spend
+	forged.Content.InputUTXOs = append([]UTXO{}, spend.Content.InputUTXOs...)
+	forged.Content.InputUTXOs[0].LockScript = "1"
+	if utxoSet.CheckTransaction(forged) {
+		t.Fatal("spend with a replaced lock script accepted")
+	}
+}
@@ -1,13 +1,66 @@
 package blockchain
 
-import "fmt"
+import (
+	"fmt"
+	"nakamoto-blockchain/logger"
+	"time"
+)
+
+// Default mempool limits, used by new pools.
+var (
+	MaxPoolSize = 50 * MaxBlockSize // bytes of encoded transactions
+	PoolExpiry  = 24 * time.Hour    // time a transaction may wait to be mined
+)
+
+// Transactions that stay locked for longer than this after the next block are
+// refused by the pool.
+var (
+	MaxPoolLockBlocks = 10
+	MaxPoolLockTime   = 30 * time.Minute
+)
 
 type TransactionPool struct {
 	Transactions map[string]Transaction
+	MaxSize      int           // above this many bytes the lowest fee rate transactions are evicted
+	Expiry       time.Duration // transactions older than this are evicted
+
+	spent   map[OutPoint]string // outpoint -> hash of the pool transaction spending it
+	entries map[string]poolEntry
+	size    int
+}
+
+// poolEntry caches what the pool needs of a transaction besides its content.
+type poolEntry struct {
+	size  int // bytes of the canonical encoding
+	fee   int64
+	added time.Time
+}
+
+// pooledTransaction is a transaction removed from the pool along with its
+// entry, so it can be put back.
+type pooledTransaction struct {
+	tx    Transaction
+	entry poolEntry
+}
+
+// PoolStats summarises the content of a transaction pool.
+type PoolStats struct {
+	Count      int
+	Size       int // bytes
+	MaxSize    int
+	TotalFees  int64
+	MinFeeRate float64 // fee per byte of the cheapest transaction
+	Oldest     int64   // unix milliseconds at which the oldest transaction entered the pool
 }
 
 func NewTransactionPool() *TransactionPool {
-	return &TransactionPool{Transactions: make(map[string]Transaction)}
+	return &TransactionPool{
+		Transactions: make(map[string]Transaction),
+		MaxSize:      MaxPoolSize,
+		Expiry:       PoolExpiry,
+		spent:        make(map[OutPoint]string),
+		entries:      make(map[string]poolEntry),
+	}
 }
 
 func (tp *TransactionPool) GetAllTransactions() []Transaction {
@@ -18,37 +71,257 @@ func (tp *TransactionPool) GetAllTransactions() []Transaction {
 	return transactions
 }
 
-func (tp *TransactionPool) GetUpToNTransactions(n int, utxoSet *UTXOSet) []Transaction {
+// Room kept in a block template for the block header and the coinbase
+const blockTemplateReserve = 1000
+
+// GetBlockTemplate selects the transactions to mine in a block of at most
+// maxBlockSize bytes. Transactions are taken as packages of a transaction and
+// its unconfirmed pool ancestors, best package fee rate (fee per byte) first,
+// so a child paying a high fee pulls in its parent. Every transaction is
+// checked against utxoSet extended with the outputs of the transactions
+// selected before it, and parents always precede their children.
+func (tp *TransactionPool) GetBlockTemplate(utxoSet *UTXOSet, maxBlockSize int) []Transaction {
 	var transactions []Transaction
-	count := 0
-	for _, tx := range tp.Transactions {
-		if count >= n {
+	selected := make(map[string]bool)
+	rejected := make(map[string]bool)
+	spent := make(map[OutPoint]bool)
+	remaining := maxBlockSize - blockTemplateReserve
+	height, timestamp := utxoSet.Height()+1, time.Now().UnixMilli()
+
+	// valid checks tx against the confirmed UTXOs and the template so far,
+	// skipping transactions whose lock time has not passed yet and, on nodes
+	// still creating legacy blocks, transactions of a newer encoding
+	valid := func(tx Transaction) bool {
+		if !tx.Verify() || !tx.IsFinal(height, timestamp) || tx.Content.Version > EncodingVersion {
+			return false
+		}
+		for _, utxo := range tx.Content.InputUTXOs {
+			if spent[utxo.OutPoint()] {
+				return false
+			}
+			if selected[utxo.TxID] {
+				if !tp.isPoolOutput(utxo) {
+					return false
+				}
+			} else if !utxoSet.CheckUTXO(utxo) || !utxoSet.IsMature(utxo) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		var best []Transaction
+		var bestFee int64
+		bestSize := 1
+		for hash := range tp.Transactions {
+			if selected[hash] || rejected[hash] {
+				continue
+			}
+			pkg, ok := tp.ancestorPackage(hash, selected, rejected)
+			if !ok {
+				rejected[hash] = true
+				continue
+			}
+
+			var fee int64
+			size := 0
+			for _, tx := range pkg {
+				entry := tp.entries[tx.Hash]
+				fee += entry.fee
+				size += entry.size
+			}
+			if size > remaining {
+				continue
+			}
+
+			// fee/size > bestFee/bestSize without rounding, ties broken by hash
+			left, right := fee*int64(bestSize), bestFee*int64(size)
+			if best == nil || left > right || (left == right && hash < best[len(best)-1].Hash) {
+				best, bestFee, bestSize = pkg, fee, size
+			}
+		}
+		if best == nil {
 			break
 		}
-		if utxoSet.CheckTransaction(tx) {
-			transactions = append(transactions, tx)
-			count++
+
+		// Add the package parents first, dropping it if any member is invalid
+		added := 0
+		for _, tx := range best {
+			if !valid(tx) {
+				rejected[tx.Hash] = true
+				break
+			}
+			selected[tx.Hash] = true
+			for _, utxo := range tx.Content.InputUTXOs {
+				spent[utxo.OutPoint()] = true
+			}
+			added++
+		}
+		if added < len(best) {
+			for _, tx := range best[:added] {
+				delete(selected, tx.Hash)
+				for _, utxo := range tx.Content.InputUTXOs {
+					delete(spent, utxo.OutPoint())
+				}
+			}
+			rejected[best[len(best)-1].Hash] = true
+			continue
 		}
+
+		transactions = append(transactions, best...)
+		remaining -= bestSize
 	}
 	return transactions
 }
 
+// ancestorPackage returns the transaction with the given hash preceded by its
+// pool ancestors that are not selected yet, parents first. It fails if any of
+// those ancestors was rejected.
+func (tp *TransactionPool) ancestorPackage(hash string, selected, rejected map[string]bool) ([]Transaction, bool) {
+	var pkg []Transaction
+	visited := make(map[string]bool)
+
+	var visit func(hash string) bool
+	visit = func(hash string) bool {
+		if visited[hash] || selected[hash] {
+			return true
+		}
+		if rejected[hash] {
+			return false
+		}
+		visited[hash] = true
+
+		tx := tp.Transactions[hash]
+		for _, utxo := range tx.Content.InputUTXOs {
+			if _, inPool := tp.Transactions[utxo.TxID]; inPool && !visit(utxo.TxID) {
+				return false
+			}
+		}
+		pkg = append(pkg, tx)
+		return true
+	}
+
+	return pkg, visit(hash)
+}
+
+// isPoolOutput reports whether utxo is an output of a pool transaction.
+func (tp *TransactionPool) isPoolOutput(utxo UTXO) bool {
+	parent, exists := tp.Transactions[utxo.TxID]
+	if !exists {
+		return false
+	}
+	output, err := parent.GetUTXO(utxo.Index)
+	return err == nil && output == utxo
+}
+
+// CheckInputs reports whether every input of tx is unspent in the mempool view
+// of the UTXO set: the confirmed UTXOs plus the outputs of pool transactions.
+// Inputs already spent by another pool transaction are left to AddTransaction.
+func (tp *TransactionPool) CheckInputs(tx Transaction, utxoSet *UTXOSet) bool {
+	for _, utxo := range tx.Content.InputUTXOs {
+		if !tp.isPoolOutput(utxo) && (!utxoSet.CheckUTXO(utxo) || !utxoSet.IsMature(utxo)) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckLockTime reports whether tx can be mined within MaxPoolLockBlocks blocks
+// and MaxPoolLockTime after the next block on top of utxoSet.
+func (tp *TransactionPool) CheckLockTime(tx Transaction, utxoSet *UTXOSet) bool {
+	return tx.IsFinal(utxoSet.Height()+1+MaxPoolLockBlocks, time.Now().Add(MaxPoolLockTime).UnixMilli())
+}
+
+// AddTransaction adds tx to the pool. If tx spends outpoints that pool
+// transactions already spend, it replaces them and their descendants as long as
+// it follows the replacement rules of checkReplacement. When the pool outgrows
+// MaxSize, the transactions with the lowest fee rate are evicted, which may be
+// tx itself. The pool is then left as it was before the call.
 func (tp *TransactionPool) AddTransaction(tx Transaction) error {
 	if _, exists := tp.Transactions[tx.Hash]; exists {
 		return fmt.Errorf("transaction with hash %s already exists in the pool", tx.Hash)
 	}
-	tp.Transactions[tx.Hash] = tx
+
+	replaced, err := tp.checkReplacement(tx)
+	if err != nil {
+		return err
+	}
+	var removed []pooledTransaction
+	for _, hash := range replaced {
+		if pooled, exists := tp.remove(hash); exists {
+			removed = append(removed, pooled)
+		}
+	}
+	tp.insert(tx, poolEntry{size: tx.Size(), fee: tx.Fee(), added: time.Now()})
+
+	removed = append(removed, tp.trim()...)
+	if !tp.HasTransaction(tx.Hash) {
+		// The pool fitted before tx came in, so putting back everything it
+		// pushed out restores it
+		for _, pooled := range removed {
+			if pooled.tx.Hash != tx.Hash {
+				tp.insert(pooled.tx, pooled.entry)
+			}
+		}
+		return fmt.Errorf("transaction %s fee rate too low for the full pool", tx.Hash)
+	}
+	if len(replaced) > 0 {
+		logger.InfoLogger.Printf("Transaction %s replaced %d pool transactions", tx.Hash, len(replaced))
+	}
 	return nil
 }
 
+// RemoveTransaction removes tx and every pool transaction spending its outputs.
 func (tp *TransactionPool) RemoveTransaction(tx Transaction) error {
 	if _, exists := tp.Transactions[tx.Hash]; !exists {
 		return fmt.Errorf("transaction with hash %s not found in the pool", tx.Hash)
 	}
-	delete(tp.Transactions, tx.Hash)
+	tp.evict(tx.Hash)
 	return nil
 }
 
+func (tp *TransactionPool) insert(tx Transaction, entry poolEntry) {
+	tp.Transactions[tx.Hash] = tx
+	for _, utxo := range tx.Content.InputUTXOs {
+		tp.spent[utxo.OutPoint()] = tx.Hash
+	}
+	tp.entries[tx.Hash] = entry
+	tp.size += entry.size
+}
+
+func (tp *TransactionPool) remove(hash string) (pooledTransaction, bool) {
+	tx, exists := tp.Transactions[hash]
+	if !exists {
+		return pooledTransaction{}, false
+	}
+	entry := tp.entries[hash]
+	delete(tp.Transactions, hash)
+	tp.size -= entry.size
+	delete(tp.entries, hash)
+	for _, utxo := range tx.Content.InputUTXOs {
+		if tp.spent[utxo.OutPoint()] == hash {
+			delete(tp.spent, utxo.OutPoint())
+		}
+	}
+	return pooledTransaction{tx: tx, entry: entry}, true
+}
+
+// evict removes the transaction with the given hash and its descendants, which
+// can no longer be mined without it, and returns them.
+func (tp *TransactionPool) evict(hash string) []pooledTransaction {
+	if _, exists := tp.Transactions[hash]; !exists {
+		return nil
+	}
+	var evicted []pooledTransaction
+	for _, descendant := range tp.descendants(hash) {
+		if pooled, exists := tp.remove(descendant); exists {
+			evicted = append(evicted, pooled)
+		}
+	}
+	return evicted
+}
+
 func (tp *TransactionPool) HasTransaction(hash string) bool {
 	_, exists := tp.Transactions[hash]
 	return exists
@@ -73,12 +346,137 @@ func (tp *TransactionPool) List() ([]Transaction, error) {
 	return transactions, nil
 }
 
-func (tp *TransactionPool) HandleStaleBlocks(staleBlocks []*Block) {
-	for _, block := range staleBlocks {
-		for _, tx := range block.Content.Transactions {
-			if !tp.HasTransaction(tx.Hash) {
+// HandleStaleBlocks returns the transactions of blocks that left the main chain
+// (given tip first, as RollbackToHash returns them) to the pool, as long as
+// they are still valid against the new UTXO set. Transactions that made it
+// into the new chain no longer have unspent inputs and are skipped.
+func (tp *TransactionPool) HandleStaleBlocks(staleBlocks []*Block, utxoSet *UTXOSet) {
+	for i := len(staleBlocks) - 1; i >= 0; i-- {
+		for _, tx := range staleBlocks[i].Content.Transactions {
+			if !tp.HasTransaction(tx.Hash) && tx.Verify() && tp.CheckInputs(tx, utxoSet) && tp.CheckLockTime(tx, utxoSet) {
 				tp.AddTransaction(tx)
 			}
 		}
 	}
 }
+
+// HandleConnectedBlocks removes pool transactions that were included in the
+// given blocks, keeping their pool children, and evicts transactions that spend
+// a UTXO one of the block transactions spent, along with their descendants.
+func (tp *TransactionPool) HandleConnectedBlocks(blocks []*Block) {
+	for _, block := range blocks {
+		for _, tx := range block.Content.Transactions {
+			tp.remove(tx.Hash)
+			for _, utxo := range tx.Content.InputUTXOs {
+				if spender, exists := tp.spent[utxo.OutPoint()]; exists {
+					tp.evict(spender)
+				}
+			}
+		}
+	}
+}
+
+// Revalidate evicts the transactions, and their descendants, that no longer
+// spend unspent outputs of utxoSet or of their pool parents, or that a shorter
+// chain pushed out of the lock time horizon, and returns how many transactions
+// it evicted.
+func (tp *TransactionPool) Revalidate(utxoSet *UTXOSet) int {
+	count := len(tp.Transactions)
+	for hash, tx := range tp.Transactions {
+		if _, exists := tp.Transactions[hash]; exists && (!tp.CheckInputs(tx, utxoSet) || !tp.CheckLockTime(tx, utxoSet)) {
+			tp.evict(hash)
+		}
+	}
+	return count - len(tp.Transactions)
+}
+
+// Expire evicts the transactions that entered the pool more than Expiry before
+// now, along with their descendants, and returns how many it evicted.
+func (tp *TransactionPool) Expire(now time.Time) int {
+	count := len(tp.Transactions)
+	for hash, entry := range tp.entries {
+		if now.Sub(entry.added) > tp.Expiry {
+			tp.evict(hash)
+		}
+	}
+	return count - len(tp.Transactions)
+}
+
+// trim evicts the transactions with the lowest fee rate until the pool fits
+// in MaxSize, and returns them.
+func (tp *TransactionPool) trim() []pooledTransaction {
+	var evicted []pooledTransaction
+	for tp.size > tp.MaxSize && len(tp.Transactions) > 0 {
+		var worst string
+		var worstFee int64
+		worstSize := 1
+		for hash := range tp.Transactions {
+			fee, size := tp.evictionScore(hash)
+			left, right := fee*int64(worstSize), worstFee*int64(size)
+			if worst == "" || left < right || (left == right && hash > worst) {
+				worst, worstFee, worstSize = hash, fee, size
+			}
+		}
+		logger.DebugLogger.Printf("Mempool full, evicting transaction %s", worst)
+		evicted = append(evicted, tp.evict(worst)...)
+	}
+	return evicted
+}
+
+// evictionScore returns the fee and size giving the fee rate used to pick the
+// transaction to evict: the better of its own fee rate and that of it together
+// with its descendants, so a parent is kept for the fee its children pay.
+func (tp *TransactionPool) evictionScore(hash string) (int64, int) {
+	fee, size := tp.entries[hash].fee, tp.entries[hash].size
+
+	var totalFee int64
+	totalSize := 0
+	for _, descendant := range tp.descendants(hash) {
+		totalFee += tp.entries[descendant].fee
+		totalSize += tp.entries[descendant].size
+	}
+
+	if totalFee*int64(size) > fee*int64(totalSize) {
+		return totalFee, totalSize
+	}
+	return fee, size
+}
+
+// descendants returns hash and the hashes of the pool transactions spending its
+// outputs, directly or not.
+func (tp *TransactionPool) descendants(hash string) []string {
+	hashes := []string{hash}
+	seen := map[string]bool{hash: true}
+	for i := 0; i < len(hashes); i++ {
+		tx := tp.Transactions[hashes[i]]
+		for index := range tx.Content.OutputUTXOs {
+			child, exists := tp.spent[OutPoint{TxID: hashes[i], Index: index}]
+			if exists && !seen[child] {
+				seen[child] = true
+				hashes = append(hashes, child)
+			}
+		}
+	}
+	return hashes
+}
+
+// Stats returns a summary of the pool content.
+func (tp *TransactionPool) Stats() PoolStats {
+	stats := PoolStats{Count: len(tp.Transactions), Size: tp.size, MaxSize: tp.MaxSize}
+	first := true
+	for hash := range tp.Transactions {
+		entry := tp.entries[hash]
+		stats.TotalFees += entry.fee
+
+		rate := float64(entry.fee) / float64(entry.size)
+		added := entry.added.UnixMilli()
+		if first || rate < stats.MinFeeRate {
+			stats.MinFeeRate = rate
+		}
+		if first || added < stats.Oldest {
+			stats.Oldest = added
+		}
+		first = false
+	}
+	return stats
+}
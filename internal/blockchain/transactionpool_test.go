@@ -0,0 +1,214 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fundedPool returns a UTXO set holding n outputs of alice and an empty pool.
+func fundedPool(t *testing.T, alice testKey, n int) ([]UTXO, *UTXOSet, *TransactionPool) {
+	t.Helper()
+	utxoSet := NewUTXOSet()
+	var utxos []UTXO
+	for i := 0; i < n; i++ {
+		utxo := UTXO{TxID: fmt.Sprint("funding", i), Index: 0, Amount: 100, Address: alice.addr}
+		utxoSet.AddUTXO(utxo)
+		utxos = append(utxos, utxo)
+	}
+	return utxos, utxoSet, NewTransactionPool()
+}
+
+func TestTransactionSizeIsCanonicalEncoding(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	tx := payment(t, UTXO{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}, alice, bob, 10, 1)
+	var e encoder
+	e.transaction(*tx)
+	if tx.Size() != len(e.buf) {
+		t.Fatalf("size %d, encoding %d bytes", tx.Size(), len(e.buf))
+	}
+
+	block := &Block{Content: BlockContent{Transactions: []Transaction{*tx}}}
+	if block.Size() != len(encodeBlock(block)) {
+		t.Fatal("block size is not that of its encoding")
+	}
+}
+
+func TestGetBlockTemplateOrdersByFeeRate(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, utxoSet, pool := fundedPool(t, alice, 3)
+	var txs []*Transaction
+	for i, fee := range []int64{1, 5, 3} {
+		tx := payment(t, utxos[i], alice, bob, 10, fee)
+		if err := pool.AddTransaction(*tx); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+
+	template := pool.GetBlockTemplate(utxoSet, MaxBlockSize)
+	want := []string{txs[1].Hash, txs[2].Hash, txs[0].Hash}
+	if len(template) != len(want) {
+		t.Fatalf("%d transactions selected, want %d", len(template), len(want))
+	}
+	for i, tx := range template {
+		if tx.Hash != want[i] {
+			t.Fatalf("transaction %d is %s, want %s", i, tx.Hash, want[i])
+		}
+	}
+
+	// Room for a single transaction besides the reserved space
+	limit := blockTemplateReserve + txs[1].Size()
+	if template := pool.GetBlockTemplate(utxoSet, limit); len(template) != 1 || template[0].Hash != txs[1].Hash {
+		t.Fatalf("size limit not applied: %d transactions selected", len(template))
+	}
+}
+
+// spendChange returns a payment from alice spending the change output of
+// parent.
+func spendChange(t *testing.T, parent *Transaction, alice, bob testKey, fee int64) *Transaction {
+	t.Helper()
+	change, err := parent.GetUTXO(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payment(t, change, alice, bob, 10, fee)
+}
+
+func TestExpireEvictsDescendants(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, _, pool := fundedPool(t, alice, 2)
+	parent := payment(t, utxos[0], alice, bob, 30, 1)
+	child := spendChange(t, parent, alice, bob, 1)
+	other := payment(t, utxos[1], alice, bob, 30, 1)
+	for _, tx := range []*Transaction{parent, child, other} {
+		if err := pool.AddTransaction(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	entry := pool.entries[parent.Hash]
+	entry.added = now.Add(-pool.Expiry - time.Minute)
+	pool.entries[parent.Hash] = entry
+
+	if expired := pool.Expire(now); expired != 2 {
+		t.Fatalf("%d transactions expired, want 2", expired)
+	}
+	if pool.HasTransaction(parent.Hash) || pool.HasTransaction(child.Hash) || !pool.HasTransaction(other.Hash) {
+		t.Fatal("expiry did not evict exactly the old transaction and its child")
+	}
+	if pool.size != other.Size() || len(pool.spent) != 1 {
+		t.Fatal("pool accounting not updated on expiry")
+	}
+}
+
+func TestRevalidateAfterReorg(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, utxoSet, pool := fundedPool(t, alice, 3)
+	reward := UTXO{TxID: "coinbase", Index: 0, Amount: 100, Address: alice.addr}
+	utxoSet.AddUTXO(reward)
+	utxoSet.coinbaseHeights[reward.TxID] = 1
+	utxoSet.height = CoinbaseMaturity
+
+	conflicting := payment(t, utxos[0], alice, bob, 30, 1)
+	child := spendChange(t, conflicting, alice, bob, 1)
+	immature := payment(t, reward, alice, bob, 30, 1)
+	locked := lockedPayment(t, utxos[1], alice, bob, int64(CoinbaseMaturity+1+MaxPoolLockBlocks))
+	kept := payment(t, utxos[2], alice, bob, 30, 1)
+	for _, tx := range []*Transaction{conflicting, child, immature, locked, kept} {
+		if !pool.CheckInputs(*tx, utxoSet) || !pool.CheckLockTime(*tx, utxoSet) {
+			t.Fatalf("transaction %s invalid before the reorg", tx.Hash)
+		}
+		if err := pool.AddTransaction(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if evicted := pool.Revalidate(utxoSet); evicted != 0 {
+		t.Fatalf("%d transactions evicted without a reorg", evicted)
+	}
+
+	// The new chain is one block shorter and spends utxos[0] elsewhere
+	if err := utxoSet.RemoveUTXO(utxos[0]); err != nil {
+		t.Fatal(err)
+	}
+	utxoSet.height--
+
+	if evicted := pool.Revalidate(utxoSet); evicted != 4 {
+		t.Fatalf("%d transactions evicted after the reorg, want 4", evicted)
+	}
+	for _, tx := range []*Transaction{conflicting, child, immature, locked} {
+		if pool.HasTransaction(tx.Hash) {
+			t.Fatalf("transaction %s kept after the reorg", tx.Hash)
+		}
+	}
+	if !pool.HasTransaction(kept.Hash) {
+		t.Fatal("valid transaction evicted after the reorg")
+	}
+}
+
+func TestTrimEvictsLowestFeeRatePackage(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, _, pool := fundedPool(t, alice, 4)
+
+	// The child lifts the package rate of its parent above the parent's own,
+	// but not above that of the other transactions
+	parent := payment(t, utxos[0], alice, bob, 30, 1)
+	child := spendChange(t, parent, alice, bob, 2)
+	high := payment(t, utxos[1], alice, bob, 30, 5)
+	medium := payment(t, utxos[2], alice, bob, 30, 3)
+	for _, tx := range []*Transaction{parent, child, high, medium} {
+		if err := pool.AddTransaction(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.MaxSize = pool.size
+
+	incoming := payment(t, utxos[3], alice, bob, 30, 4)
+	if err := pool.AddTransaction(*incoming); err != nil {
+		t.Fatal(err)
+	}
+	if pool.HasTransaction(parent.Hash) || pool.HasTransaction(child.Hash) {
+		t.Fatal("lowest fee rate package kept in the full pool")
+	}
+	for _, tx := range []*Transaction{high, medium, incoming} {
+		if !pool.HasTransaction(tx.Hash) {
+			t.Fatalf("transaction %s evicted instead of the lowest fee rate package", tx.Hash)
+		}
+	}
+	if pool.size > pool.MaxSize {
+		t.Fatalf("pool holds %d bytes, more than its %d maximum", pool.size, pool.MaxSize)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	utxos, _, pool := fundedPool(t, alice, 2)
+	if stats := pool.Stats(); stats != (PoolStats{MaxSize: MaxPoolSize}) {
+		t.Fatalf("empty pool stats %+v", stats)
+	}
+
+	cheap := payment(t, utxos[0], alice, bob, 30, 2)
+	dear := payment(t, utxos[1], alice, bob, 30, 6)
+	for _, tx := range []*Transaction{cheap, dear} {
+		if err := pool.AddTransaction(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldest := time.Now().Add(-time.Hour)
+	entry := pool.entries[dear.Hash]
+	entry.added = oldest
+	pool.entries[dear.Hash] = entry
+
+	want := PoolStats{
+		Count:      2,
+		Size:       cheap.Size() + dear.Size(),
+		MaxSize:    MaxPoolSize,
+		TotalFees:  8,
+		MinFeeRate: 2 / float64(cheap.Size()),
+		Oldest:     oldest.UnixMilli(),
+	}
+	if stats := pool.Stats(); stats != want {
+		t.Fatalf("pool stats %+v, want %+v", stats, want)
+	}
+}
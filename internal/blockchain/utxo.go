@@ -1,21 +1,64 @@
 package blockchain
 
-import "fmt"
+import (
+	"fmt"
+	"nakamoto-blockchain/internal/script"
+	"sort"
+	"time"
+)
 
 // UTXOs for an address
 type UTXOSet struct {
-	utxos map[string][]UTXO
+	utxos           map[string][]UTXO
+	height          int            // height of the last block applied with AddBlock
+	coinbaseHeights map[string]int // coinbase transaction hash -> height of its block
 }
 
 type UTXO struct {
-	TxID    string
-	Index   int
-	Amount  int64
-	Address string
+	TxID       string
+	Index      int
+	Amount     int64
+	Address    string
+	LockScript string `json:",omitempty"` // spending conditions, see package script; empty for outputs spent with the key of Address
+	LockTime   int64  `json:",omitempty"` // block height or time before which the output cannot be spent, see LockTimeThreshold
+}
+
+// OutPoint identifies a transaction output, independently of its amount and owner.
+type OutPoint struct {
+	TxID  string
+	Index int
+}
+
+func (utxo UTXO) OutPoint() OutPoint {
+	return OutPoint{TxID: utxo.TxID, Index: utxo.Index}
+}
+
+// validLockScript reports whether utxo has no locking script or a valid one,
+// filed under its address.
+func (utxo UTXO) validLockScript() bool {
+	if utxo.LockScript == "" {
+		return true
+	}
+	return script.Validate(utxo.LockScript) == nil && utxo.Address == script.Address(utxo.LockScript)
 }
 
 func NewUTXOSet() *UTXOSet {
-	return &UTXOSet{utxos: make(map[string][]UTXO)}
+	return &UTXOSet{
+		utxos:           make(map[string][]UTXO),
+		coinbaseHeights: make(map[string]int),
+	}
+}
+
+// Height returns the height of the last block applied to the set.
+func (u *UTXOSet) Height() int {
+	return u.height
+}
+
+// IsMature reports whether utxo may be spent in the block following the last
+// applied block, which only matters for coinbase outputs.
+func (u *UTXOSet) IsMature(utxo UTXO) bool {
+	height, isCoinbase := u.coinbaseHeights[utxo.TxID]
+	return !isCoinbase || u.height+1-height >= CoinbaseMaturity
 }
 
 func (u *UTXOSet) PrintAllUTXOs() {
@@ -35,6 +78,24 @@ func (u *UTXOSet) Get(address string) []UTXO {
 	return []UTXO{}
 }
 
+// All returns every UTXO in the set in a deterministic order.
+func (u *UTXOSet) All() []UTXO {
+	all := []UTXO{}
+	for _, utxos := range u.utxos {
+		all = append(all, utxos...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].TxID != all[j].TxID {
+			return all[i].TxID < all[j].TxID
+		}
+		if all[i].Index != all[j].Index {
+			return all[i].Index < all[j].Index
+		}
+		return all[i].Address < all[j].Address
+	})
+	return all
+}
+
 func (u *UTXOSet) CheckUTXO(utxo UTXO) bool {
 	for _, ut := range u.Get(utxo.Address) {
 		if ut == utxo {
@@ -44,13 +105,22 @@ func (u *UTXOSet) CheckUTXO(utxo UTXO) bool {
 	return false
 }
 
+// CheckTransaction checks that tx is valid and spends unspent, mature UTXOs in
+// the block following the last applied block, mined now. The locking scripts
+// and lock times tx.Verify and tx.IsFinal check are those of the inputs as given
+// in tx, so matching them against the set here is what makes them binding.
 func (u *UTXOSet) CheckTransaction(tx Transaction) bool {
-	if !tx.Verify() {
+	return u.checkTransaction(tx, u.height+1, time.Now().UnixMilli())
+}
+
+// checkTransaction is CheckTransaction for a block at height with timestamp.
+func (u *UTXOSet) checkTransaction(tx Transaction, height int, timestamp int64) bool {
+	if !tx.Verify() || !tx.IsFinal(height, timestamp) {
 		return false
 	}
 
 	for _, utxo := range tx.Content.InputUTXOs {
-		if !u.CheckUTXO(utxo) {
+		if !u.CheckUTXO(utxo) || !u.IsMature(utxo) {
 			return false
 		}
 	}
@@ -78,13 +148,21 @@ func (u *UTXOSet) RemoveUTXO(utxo UTXO) error {
 }
 
 func (u *UTXOSet) AddTransaction(tx Transaction) error {
-	if !u.CheckTransaction(tx) {
+	return u.addTransaction(tx, u.height+1, time.Now().UnixMilli())
+}
+
+// addTransaction is AddTransaction for a block at height with timestamp.
+func (u *UTXOSet) addTransaction(tx Transaction, height int, timestamp int64) error {
+	if !u.checkTransaction(tx, height, timestamp) {
 		return fmt.Errorf("invalid transaction")
 	}
 
-	for _, utxo := range tx.Content.InputUTXOs {
+	for i, utxo := range tx.Content.InputUTXOs {
 		err := u.RemoveUTXO(utxo)
 		if err != nil {
+			for _, spent := range tx.Content.InputUTXOs[:i] {
+				u.AddUTXO(spent)
+			}
 			return err
 		}
 	}
@@ -97,38 +175,93 @@ func (u *UTXOSet) AddTransaction(tx Transaction) error {
 	return nil
 }
 
+// AddBlock applies every transaction of the block, or none of them if any
+// transaction is invalid. The block must follow the last applied block and
+// start with a coinbase claiming no more than the subsidy and the fees.
+// Transactions are applied in order, so a transaction may spend outputs of an
+// earlier one in the same block, but no outpoint may be spent twice.
 func (u *UTXOSet) AddBlock(b *Block) error {
-	for _, tx := range b.Content.Transactions {
-		if !u.CheckTransaction(tx) {
-			return fmt.Errorf("invalid transaction in block")
+	if len(b.Content.Transactions) == 0 || !b.Content.Transactions[0].VerifyCoinbase(b.Header.Height) {
+		return fmt.Errorf("block does not start with a valid coinbase")
+	}
+	coinbase := b.Content.Transactions[0]
+	transactions := b.Content.Transactions[1:]
+
+	spent := make(map[OutPoint]string)
+	for _, tx := range transactions {
+		for _, utxo := range tx.Content.InputUTXOs {
+			if spender, exists := spent[utxo.OutPoint()]; exists {
+				return fmt.Errorf("transaction %s spends output %d of %s already spent by %s in the block", tx.Hash, utxo.Index, utxo.TxID, spender)
+			}
+			spent[utxo.OutPoint()] = tx.Hash
 		}
 	}
-	for _, tx := range b.Content.Transactions {
-		err := u.AddTransaction(tx)
+	reward, ok := b.Reward()
+	if !ok {
+		return fmt.Errorf("block has transactions with invalid amounts")
+	}
+	if coinbase.OutputAmount() > reward {
+		return fmt.Errorf("coinbase claims %d, more than the block reward of %d", coinbase.OutputAmount(), reward)
+	}
+
+	for i, tx := range transactions {
+		err := u.addTransaction(tx, b.Header.Height, b.Header.Timestamp)
 		if err != nil {
-			return err
+			for j := i - 1; j >= 0; j-- {
+				u.removeTransaction(transactions[j])
+			}
+			return fmt.Errorf("invalid transaction %s in block: %v", tx.Hash, err)
 		}
 	}
+
+	for i := range coinbase.Content.OutputUTXOs {
+		utxo, _ := coinbase.GetUTXO(i)
+		u.AddUTXO(utxo)
+	}
+	u.coinbaseHeights[coinbase.Hash] = b.Header.Height
+	u.height = b.Header.Height
 	return nil
 }
 
+// RemoveBlock undoes every transaction of the block, or none of them if the
+// set does not contain the block's outputs.
 func (u *UTXOSet) RemoveBlock(b *Block) error {
 	for i := len(b.Content.Transactions) - 1; i >= 0; i-- {
-		tx := b.Content.Transactions[i]
-
-		for _, utxo := range tx.Content.OutputUTXOs {
-			err := u.RemoveUTXO(utxo)
-			if err != nil {
-				return fmt.Errorf("failed to remove UTXO: %v", err)
+		if err := u.removeTransaction(b.Content.Transactions[i]); err != nil {
+			for _, tx := range b.Content.Transactions[i+1:] {
+				u.addTransaction(tx, b.Header.Height, b.Header.Timestamp)
 			}
+			return err
 		}
+	}
 
-		// Restore inputs: Add UTXOs that were consumed by this transaction
-		for _, utxo := range tx.Content.InputUTXOs {
-			u.AddUTXO(utxo)
+	if len(b.Content.Transactions) > 0 {
+		delete(u.coinbaseHeights, b.Content.Transactions[0].Hash)
+	}
+	u.height = b.Header.Height - 1
+	return nil
+}
+
+// removeTransaction undoes AddTransaction: the outputs created by tx are
+// removed and the UTXOs it consumed are restored.
+func (u *UTXOSet) removeTransaction(tx Transaction) error {
+	for j := range tx.Content.OutputUTXOs {
+		utxo, _ := tx.GetUTXO(j)
+		if !u.CheckUTXO(utxo) {
+			return fmt.Errorf("failed to remove UTXO: output %d of %s is not in the set", j, tx.Hash)
 		}
 	}
 
+	for j := range tx.Content.OutputUTXOs {
+		utxo, _ := tx.GetUTXO(j)
+		u.RemoveUTXO(utxo)
+	}
+
+	// Restore inputs: Add UTXOs that were consumed by this transaction
+	for _, utxo := range tx.Content.InputUTXOs {
+		u.AddUTXO(utxo)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,78 @@
+package blockchain
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddBlockRejectsDoubleSpendWithinBlock(t *testing.T) {
+	alice, bob, carol := newTestKey(t), newTestKey(t), newTestKey(t)
+	input := UTXO{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}
+	utxoSet := NewUTXOSet()
+	utxoSet.AddUTXO(input)
+
+	toBob := payment(t, input, alice, bob, 10, 0)
+	toCarol := payment(t, input, alice, carol, 10, 0)
+	block := &Block{Header: BlockHeader{Height: 1}, Content: BlockContent{Transactions: []Transaction{coinbase(t, 1), *toBob, *toCarol}}}
+	err := utxoSet.AddBlock(block)
+	if err == nil || !strings.Contains(err.Error(), "already spent") {
+		t.Fatalf("got %v, want a double spend error", err)
+	}
+	if utxoSet.Balance(alice.addr) != 100 || utxoSet.Balance(bob.addr) != 0 || len(utxoSet.All()) != 1 {
+		t.Fatal("UTXO set changed by a rejected block")
+	}
+}
+
+func TestAddBlockAppliesChainedTransactionsInOrder(t *testing.T) {
+	alice, bob, carol := newTestKey(t), newTestKey(t), newTestKey(t)
+	input := UTXO{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}
+	utxoSet := NewUTXOSet()
+	utxoSet.AddUTXO(input)
+
+	parent := payment(t, input, alice, bob, 10, 0)
+	output, err := parent.GetUTXO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := payment(t, output, bob, carol, 4, 1)
+	block := &Block{Header: BlockHeader{Height: 1}, Content: BlockContent{Transactions: []Transaction{coinbase(t, 1), *parent, *child}}}
+	if err := utxoSet.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if utxoSet.Balance(carol.addr) != 4 || utxoSet.Balance(bob.addr) != 5 {
+		t.Fatal("chained payment not applied")
+	}
+
+	if err := utxoSet.RemoveBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if utxoSet.Balance(alice.addr) != 100 || len(utxoSet.All()) != 1 {
+		t.Fatal("UTXO set not restored")
+	}
+
+	// The child before its parent spends an output that does not exist yet
+	reversed := &Block{Header: BlockHeader{Height: 1}, Content: BlockContent{Transactions: []Transaction{coinbase(t, 1), *child, *parent}}}
+	if err := utxoSet.AddBlock(reversed); err == nil {
+		t.Fatal("child applied before its parent")
+	}
+}
+
+func TestPoolRejectsDoubleSpendAndEvictsConfirmedConflicts(t *testing.T) {
+	alice, bob, carol := newTestKey(t), newTestKey(t), newTestKey(t)
+	input := UTXO{TxID: "aa", Index: 0, Amount: 100, Address: alice.addr}
+	toBob := payment(t, input, alice, bob, 10, 0)
+	toCarol := payment(t, input, alice, carol, 10, 0)
+
+	pool := NewTransactionPool()
+	if err := pool.AddTransaction(*toBob); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.AddTransaction(*toCarol); err == nil {
+		t.Fatal("double spend accepted without paying for a replacement")
+	}
+
+	pool.HandleConnectedBlocks([]*Block{{Content: BlockContent{Transactions: []Transaction{*toCarol}}}})
+	if len(pool.Transactions) != 0 || len(pool.spent) != 0 {
+		t.Fatal("transaction conflicting with a block left in the pool")
+	}
+}
@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	genesisTimestamp   = 1704067200000 // 2024-01-01 00:00:00 UTC, in milliseconds
+	medianTimeBlocks   = 11            // blocks used for the median time past
+	maxFutureBlockTime = 2 * 60 * 1000 // milliseconds a block may be ahead of our clock
+)
+
+// Reasons a block header is rejected by checkBlockHeader
+var (
+	ErrBadGenesis    = errors.New("genesis block mismatch")
+	ErrBadPrevious   = errors.New("previous hash mismatch")
+	ErrBadHeight     = errors.New("height mismatch")
+	ErrBadDifficulty = errors.New("unexpected difficulty")
+	ErrTimeTooOld    = errors.New("timestamp not after median time past")
+	ErrTimeTooNew    = errors.New("timestamp too far in the future")
+	ErrBadVersion    = errors.New("unexpected block version")
+)
+
+// GenesisBlock returns the genesis block every node starts from. It is fixed,
+// so all nodes agree on its hash.
+func GenesisBlock() *Block {
+	block := &Block{
+		Header: BlockHeader{
+			Timestamp:  genesisTimestamp,
+			Height:     0,
+			Difficulty: initialDifficulty,
+		},
+	}
+	block.Header.ContentHash, _ = block.CalculateContentHash()
+	block.Hash, _ = block.CalculateHash()
+	return block
+}
+
+// checkBlockHeader validates the header of block in the context of its parent,
+// which is nil only when block claims to be the genesis block.
+func checkBlockHeader(block *Block, parent *BlockNode) error {
+	if parent == nil || block.Header.Height == 0 {
+		if block.Hash != GenesisBlock().Hash {
+			return fmt.Errorf("%w: got %s", ErrBadGenesis, block.Hash)
+		}
+		return nil
+	}
+
+	if block.Header.PreviousHash != parent.Hash {
+		return fmt.Errorf("%w: expected %s, got %s", ErrBadPrevious, parent.Hash, block.Header.PreviousHash)
+	}
+
+	if block.Header.Height != parent.Header.Height+1 {
+		return fmt.Errorf("%w: expected %d, got %d", ErrBadHeight, parent.Header.Height+1, block.Header.Height)
+	}
+
+	// Once a chain switched to a newer encoding it cannot go back, so legacy
+	// hashes are only accepted below the first canonical block.
+	if v := block.Header.Version; v < parent.Header.Version || v > CanonicalEncoding {
+		return fmt.Errorf("%w: %d after %d", ErrBadVersion, v, parent.Header.Version)
+	}
+
+	if expected := nextDifficulty(parent); block.Header.Difficulty != expected {
+		return fmt.Errorf("%w: expected %s, got %s", ErrBadDifficulty, expected, block.Header.Difficulty)
+	}
+
+	if median := medianTimePast(parent); block.Header.Timestamp <= median {
+		return fmt.Errorf("%w: %d <= %d", ErrTimeTooOld, block.Header.Timestamp, median)
+	}
+
+	if limit := time.Now().UnixMilli() + maxFutureBlockTime; block.Header.Timestamp > limit {
+		return fmt.Errorf("%w: %d > %d", ErrTimeTooNew, block.Header.Timestamp, limit)
+	}
+
+	return nil
+}
+
+// medianTimePast returns the median timestamp of node and up to
+// medianTimeBlocks-1 of its ancestors.
+func medianTimePast(node *BlockNode) int64 {
+	var timestamps []int64
+	for ; node != nil && len(timestamps) < medianTimeBlocks; node = node.Parent {
+		timestamps = append(timestamps, node.Header.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
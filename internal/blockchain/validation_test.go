@@ -0,0 +1,71 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckBlockHeaderRejections(t *testing.T) {
+	bc := NewBlockchain(nil)
+	genesis := bc.index.Lookup(bc.Blocks[0].Hash)
+	valid := func() *Block {
+		return &Block{Header: BlockHeader{
+			PreviousHash: genesis.Hash,
+			Height:       1,
+			Difficulty:   nextDifficulty(genesis),
+			Timestamp:    time.Now().UnixMilli(),
+			Version:      CanonicalEncoding,
+		}}
+	}
+	if err := checkBlockHeader(valid(), genesis); err != nil {
+		t.Fatalf("valid header rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Block)
+		want   error
+	}{
+		{"previous hash", func(b *Block) { b.Header.PreviousHash = "00" }, ErrBadPrevious},
+		{"height", func(b *Block) { b.Header.Height = 2 }, ErrBadHeight},
+		{"difficulty", func(b *Block) { b.Header.Difficulty = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff" }, ErrBadDifficulty},
+		{"version", func(b *Block) { b.Header.Version = CanonicalEncoding + 1 }, ErrBadVersion},
+		{"timestamp at median time past", func(b *Block) { b.Header.Timestamp = genesis.Header.Timestamp }, ErrTimeTooOld},
+		{"timestamp in the future", func(b *Block) { b.Header.Timestamp += maxFutureBlockTime + time.Hour.Milliseconds() }, ErrTimeTooNew},
+	}
+	for _, tt := range tests {
+		block := valid()
+		tt.modify(block)
+		if err := checkBlockHeader(block, genesis); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCheckBlockHeaderRejectsVersionDowngrade(t *testing.T) {
+	parent := &BlockNode{Hash: "parent", Header: BlockHeader{Height: 1, Version: CanonicalEncoding, Difficulty: initialDifficulty}}
+	block := &Block{Header: BlockHeader{
+		PreviousHash: parent.Hash,
+		Height:       2,
+		Difficulty:   nextDifficulty(parent),
+		Timestamp:    time.Now().UnixMilli(),
+		Version:      LegacyEncoding,
+	}}
+	if err := checkBlockHeader(block, parent); !errors.Is(err, ErrBadVersion) {
+		t.Fatalf("got %v, want ErrBadVersion", err)
+	}
+}
+
+func TestCheckBlockHeaderRejectsOtherGenesis(t *testing.T) {
+	genesis := GenesisBlock()
+	other := *genesis
+	other.Header.Timestamp++
+	other.Hash, _ = other.CalculateHash()
+	if err := checkBlockHeader(genesis, nil); err != nil {
+		t.Fatalf("genesis rejected: %v", err)
+	}
+	if err := checkBlockHeader(&other, nil); !errors.Is(err, ErrBadGenesis) {
+		t.Fatalf("got %v, want ErrBadGenesis", err)
+	}
+}
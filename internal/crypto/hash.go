@@ -15,3 +15,9 @@ func Hash(data interface{}) (string, error) {
 	hash := sha256.Sum256(jsonData)
 	return hex.EncodeToString(hash[:]), nil
 }
+
+// HashBytes calculates the SHA-256 hash of data and returns it as a hexadecimal string.
+func HashBytes(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -26,8 +26,11 @@ func Sign(hash string, privateKeyStr string) (string, error) {
 		return "", err
 	}
 
-	signature := r.Bytes()
-	signature = append(signature, s.Bytes()...)
+	// r and s are padded to the curve size so the signature splits evenly
+	size := (privateKey.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
 
 	return hex.EncodeToString(signature), nil
 }
@@ -56,6 +59,21 @@ func VerifySignature(hash, signature string, publicKeyStr string) (bool, error)
 	return ecdsa.Verify(publicKey, hashBytes, r, s), nil
 }
 
+// PublicKey returns the base64 encoded public key belonging to a private key.
+func PublicKey(privateKeyStr string) (string, error) {
+	privateKey, err := parsePrivateKey(privateKeyStr)
+	if err != nil {
+		return "", err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(publicKeyBytes), nil
+}
+
 // parsePrivateKey converts a base64 encoded private key string to an ecdsa.PrivateKey.
 func parsePrivateKey(privateKeyStr string) (*ecdsa.PrivateKey, error) {
 	privateKeyBytes, err := base64.StdEncoding.DecodeString(privateKeyStr)
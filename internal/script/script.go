@@ -0,0 +1,289 @@
+// Package script implements the small stack language locking transaction
+// outputs. A script is a list of space separated tokens: tokens starting with
+// OP_ are operations, anything else (numbers, base64 keys, signatures and
+// addresses) is pushed on the stack as is.
+//
+// An input is unlocked by running its unlocking script followed by the locking
+// script of the output it spends on the same stack. The input is valid if both
+// run without error and leave a single true value on the stack. Unlocking data
+// is not covered by the transaction hash, so nothing else may be left over, or
+// anyone relaying a transaction could pad it with extra pushes.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"nakamoto-blockchain/internal/crypto"
+	"strconv"
+	"strings"
+)
+
+// Script limits, keeping the work needed to check an input bounded.
+const (
+	MaxScriptSize = 10000 // bytes
+	MaxStackSize  = 100
+	MaxMultisig   = 20 // public keys in an OP_CHECKMULTISIG
+)
+
+// Operations
+const (
+	OpDup                 = "OP_DUP"
+	OpDrop                = "OP_DROP"
+	OpEqual               = "OP_EQUAL"
+	OpEqualVerify         = "OP_EQUALVERIFY"
+	OpVerify              = "OP_VERIFY"
+	OpAddr                = "OP_ADDR" // replaces a public key with its address
+	OpCheckSig            = "OP_CHECKSIG"
+	OpCheckSigVerify      = "OP_CHECKSIGVERIFY"
+	OpCheckMultisig       = "OP_CHECKMULTISIG"
+	OpCheckMultisigVerify = "OP_CHECKMULTISIGVERIFY"
+)
+
+var (
+	ErrInvalidScript = errors.New("invalid script")
+	ErrScriptFailed  = errors.New("script failed")
+)
+
+const (
+	stackTrue  = "1"
+	stackFalse = "0"
+)
+
+// Validate checks that s is a well formed script using known operations only.
+func Validate(s string) error {
+	_, err := parse(s)
+	return err
+}
+
+// Execute runs unlock followed by lock, checking signatures against sigHash,
+// and returns an error unless the input is unlocked. The unlocking script may
+// only push data, so it cannot change how the locking script runs.
+func Execute(unlock, lock, sigHash string) error {
+	unlockOps, err := parse(unlock)
+	if err != nil {
+		return err
+	}
+	for _, op := range unlockOps {
+		if isOperation(op) {
+			return fmt.Errorf("%w: unlocking script contains operation %s", ErrInvalidScript, op)
+		}
+	}
+
+	lockOps, err := parse(lock)
+	if err != nil {
+		return err
+	}
+
+	e := &engine{sigHash: sigHash}
+	if err := e.run(unlockOps); err != nil {
+		return err
+	}
+	if err := e.run(lockOps); err != nil {
+		return err
+	}
+
+	if len(e.stack) != 1 {
+		return fmt.Errorf("%w: %d values left on the stack, want 1", ErrScriptFailed, len(e.stack))
+	}
+	if !isTrue(e.stack[0]) {
+		return fmt.Errorf("%w: false on top of the stack", ErrScriptFailed)
+	}
+	return nil
+}
+
+func parse(s string) ([]string, error) {
+	if len(s) > MaxScriptSize {
+		return nil, fmt.Errorf("%w: longer than %d bytes", ErrInvalidScript, MaxScriptSize)
+	}
+	ops := strings.Fields(s)
+	for _, op := range ops {
+		if isOperation(op) && !knownOperations[op] {
+			return nil, fmt.Errorf("%w: unknown operation %s", ErrInvalidScript, op)
+		}
+	}
+	return ops, nil
+}
+
+var knownOperations = map[string]bool{
+	OpDup: true, OpDrop: true, OpEqual: true, OpEqualVerify: true, OpVerify: true, OpAddr: true,
+	OpCheckSig: true, OpCheckSigVerify: true, OpCheckMultisig: true, OpCheckMultisigVerify: true,
+}
+
+func isOperation(token string) bool {
+	return strings.HasPrefix(token, "OP_")
+}
+
+func isTrue(value string) bool {
+	return value != "" && value != stackFalse
+}
+
+func boolValue(b bool) string {
+	if b {
+		return stackTrue
+	}
+	return stackFalse
+}
+
+type engine struct {
+	stack   []string
+	sigHash string
+}
+
+func (e *engine) push(value string) error {
+	if len(e.stack) >= MaxStackSize {
+		return fmt.Errorf("%w: stack larger than %d items", ErrScriptFailed, MaxStackSize)
+	}
+	e.stack = append(e.stack, value)
+	return nil
+}
+
+func (e *engine) pop() (string, error) {
+	if len(e.stack) == 0 {
+		return "", fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+	}
+	value := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return value, nil
+}
+
+func (e *engine) popInt() (int, error) {
+	value, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q is not a number", ErrScriptFailed, value)
+	}
+	return n, nil
+}
+
+func (e *engine) run(ops []string) error {
+	for _, op := range ops {
+		if err := e.step(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *engine) step(op string) error {
+	switch op {
+	case OpDup:
+		if len(e.stack) == 0 {
+			return fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+		}
+		return e.push(e.stack[len(e.stack)-1])
+
+	case OpDrop:
+		_, err := e.pop()
+		return err
+
+	case OpEqual, OpEqualVerify:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.result(op == OpEqualVerify, a == b)
+
+	case OpVerify:
+		value, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.result(true, isTrue(value))
+
+	case OpAddr:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.push(crypto.Key2Addr(pubKey))
+
+	case OpCheckSig, OpCheckSigVerify:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.result(op == OpCheckSigVerify, e.checkSig(signature, pubKey))
+
+	case OpCheckMultisig, OpCheckMultisigVerify:
+		valid, err := e.checkMultisig()
+		if err != nil {
+			return err
+		}
+		return e.result(op == OpCheckMultisigVerify, valid)
+
+	default:
+		return e.push(op)
+	}
+}
+
+// result pushes the outcome of an operation, or fails the script on a false
+// outcome of a VERIFY operation.
+func (e *engine) result(verify, ok bool) error {
+	if !verify {
+		return e.push(boolValue(ok))
+	}
+	if !ok {
+		return fmt.Errorf("%w: verify failed", ErrScriptFailed)
+	}
+	return nil
+}
+
+func (e *engine) checkSig(signature, pubKey string) bool {
+	valid, err := crypto.VerifySignature(e.sigHash, signature, pubKey)
+	return err == nil && valid
+}
+
+// checkMultisig pops n, n public keys, m and m signatures. The signatures must
+// be made by m of the keys, in the same order as the keys.
+func (e *engine) checkMultisig() (bool, error) {
+	n, err := e.popInt()
+	if err != nil {
+		return false, err
+	}
+	if n < 1 || n > MaxMultisig {
+		return false, fmt.Errorf("%w: %d public keys", ErrScriptFailed, n)
+	}
+	pubKeys := make([]string, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := e.popInt()
+	if err != nil {
+		return false, err
+	}
+	if m < 1 || m > n {
+		return false, fmt.Errorf("%w: %d of %d signatures", ErrScriptFailed, m, n)
+	}
+	signatures := make([]string, m)
+	for i := m - 1; i >= 0; i-- {
+		if signatures[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	key := 0
+	for _, signature := range signatures {
+		for key < n && !e.checkSig(signature, pubKeys[key]) {
+			key++
+		}
+		if key == n {
+			return false, nil
+		}
+		key++
+	}
+	return true, nil
+}
@@ -0,0 +1,75 @@
+package script
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"nakamoto-blockchain/internal/crypto"
+	"testing"
+)
+
+func newKey(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	privBytes, _ := x509.MarshalECPrivateKey(key)
+	return base64.StdEncoding.EncodeToString(privBytes), base64.StdEncoding.EncodeToString(pubBytes)
+}
+
+func TestExecuteRequiresCleanStack(t *testing.T) {
+	priv, pub := newKey(t)
+	sigHash := crypto.HashBytes([]byte("transaction"))
+	signature, err := crypto.Sign(sigHash, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := PayToPubKeyHash(crypto.Key2Addr(pub))
+
+	if err := Execute(PayToPubKeyHashUnlock(signature, pub), lock, sigHash); err != nil {
+		t.Fatalf("valid unlocking script rejected: %v", err)
+	}
+
+	// The extra values sit below the ones the locking script consumes
+	for _, unlock := range []string{
+		"1 " + PayToPubKeyHashUnlock(signature, pub),
+		"junk 1 " + PayToPubKeyHashUnlock(signature, pub),
+	} {
+		if err := Execute(unlock, lock, sigHash); !errors.Is(err, ErrScriptFailed) {
+			t.Fatalf("unlocking script %q with extra pushes: %v", unlock, err)
+		}
+	}
+}
+
+func TestExecuteMultisig(t *testing.T) {
+	sigHash := crypto.HashBytes([]byte("transaction"))
+	var pubKeys, signatures []string
+	for i := 0; i < 3; i++ {
+		priv, pub := newKey(t)
+		signature, err := crypto.Sign(sigHash, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeys = append(pubKeys, pub)
+		signatures = append(signatures, signature)
+	}
+	lock, err := Multisig(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Execute(MultisigUnlock([]string{signatures[0], signatures[2]}), lock, sigHash); err != nil {
+		t.Fatalf("2 of 3 signatures rejected: %v", err)
+	}
+	if err := Execute(MultisigUnlock([]string{"1", signatures[0], signatures[2]}), lock, sigHash); err == nil {
+		t.Fatal("multisig unlock with an extra push accepted")
+	}
+	if err := Execute(MultisigUnlock([]string{signatures[2], signatures[0]}), lock, sigHash); err == nil {
+		t.Fatal("signatures out of key order accepted")
+	}
+}
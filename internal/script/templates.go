@@ -0,0 +1,54 @@
+package script
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version byte of addresses identifying a locking script rather than a key
+const scriptAddressVersion = 0x05
+
+// PayToPubKeyHash returns the locking script paying to the owner of the key
+// with the given address.
+func PayToPubKeyHash(address string) string {
+	return strings.Join([]string{OpDup, OpAddr, address, OpEqualVerify, OpCheckSig}, " ")
+}
+
+// PayToPubKeyHashUnlock returns the unlocking script spending a
+// pay-to-pubkey-hash output with a signature made by pubKey.
+func PayToPubKeyHashUnlock(signature, pubKey string) string {
+	return signature + " " + pubKey
+}
+
+// Multisig returns the locking script spendable with signatures of m of the
+// given public keys.
+func Multisig(m int, pubKeys []string) (string, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > MaxMultisig || m < 1 || m > len(pubKeys) {
+		return "", fmt.Errorf("%w: %d of %d multisig", ErrInvalidScript, m, len(pubKeys))
+	}
+	tokens := []string{strconv.Itoa(m)}
+	tokens = append(tokens, pubKeys...)
+	tokens = append(tokens, strconv.Itoa(len(pubKeys)), OpCheckMultisig)
+	return strings.Join(tokens, " "), nil
+}
+
+// MultisigUnlock returns the unlocking script of a multisig output. The
+// signatures must be in the order of their keys in the locking script.
+func MultisigUnlock(signatures []string) string {
+	return strings.Join(signatures, " ")
+}
+
+// Address returns the address an output locked by lock is filed under: the
+// key address of a pay-to-pubkey-hash script, or a hash of any other script.
+func Address(lock string) string {
+	tokens := strings.Fields(lock)
+	if len(tokens) == 5 && PayToPubKeyHash(tokens[2]) == strings.Join(tokens, " ") {
+		return tokens[2]
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(tokens, " ")))
+	return base64.StdEncoding.EncodeToString(append([]byte{scriptAddressVersion}, hash[:20]...))
+}
@@ -6,26 +6,43 @@ import (
 	"math/rand"
 	"nakamoto-blockchain/internal/blockchain"
 	"nakamoto-blockchain/logger"
+	"sync"
 	"time"
 )
 
+// BlockchainServer is the node. Blockchain (including its UTXO set) and TxPool
+// are guarded by mu: handlers take the write lock for any change and the read
+// lock for queries, and never hold it across calls to peers or while mining.
+// The mining state has its own lock, miningMu, and so has the sync state.
 type BlockchainServer struct {
 	Blockchain  *blockchain.Blockchain
 	TxPool      *blockchain.TransactionPool
+	mu          sync.RWMutex
+	miningMu    sync.Mutex
 	cancelFunc  context.CancelFunc
 	mining      bool
+	syncMu      sync.Mutex
+	syncing     bool
 	Comms       OutgoingCommunicator
 	PeerManager *PeerManager
 	mode        int
+
+	// BlockSizeLimit caps the size of mined blocks, at most blockchain.MaxBlockSize
+	BlockSizeLimit int
+
+	rewardAddress string // receives the coinbase of mined blocks
 }
 
-func NewBlockchainServer(comms OutgoingCommunicator, peerManager *PeerManager, initialUTXOs []blockchain.UTXO, mode int) *BlockchainServer {
+func NewBlockchainServer(comms OutgoingCommunicator, peerManager *PeerManager, bc *blockchain.Blockchain, mode int, rewardAddress string) *BlockchainServer {
 	return &BlockchainServer{
-		Blockchain:  blockchain.NewBlockchain(initialUTXOs),
-		TxPool:      blockchain.NewTransactionPool(),
-		Comms:       comms,
-		PeerManager: peerManager,
-		mode:        mode,
+		Blockchain:    bc,
+		TxPool:        blockchain.NewTransactionPool(),
+		Comms:         comms,
+		PeerManager:   peerManager,
+		mode:          mode,
+		rewardAddress: rewardAddress,
+
+		BlockSizeLimit: blockchain.MaxBlockSize,
 	}
 }
 
@@ -37,8 +54,26 @@ func (s *BlockchainServer) HandleTransactionSubmission(tx *blockchain.Transactio
 		return false, fmt.Errorf("invalid transaction")
 	}
 
-	if !s.TxPool.HasTransaction(tx.Hash) && !s.Blockchain.HasTransaction(tx.Hash) {
-		s.TxPool.AddTransaction(*tx)
+	s.mu.Lock()
+	added := !s.TxPool.HasTransaction(tx.Hash) && !s.Blockchain.HasTransaction(tx.Hash)
+	var err error
+	if added {
+		if !s.TxPool.CheckInputs(*tx, s.Blockchain.UTXOSet) {
+			err = fmt.Errorf("transaction %s spends unknown or immature outputs", tx.Hash)
+		} else if !s.TxPool.CheckLockTime(*tx, s.Blockchain.UTXOSet) {
+			err = fmt.Errorf("transaction %s is locked for too long to enter the pool", tx.Hash)
+		} else {
+			err = s.TxPool.AddTransaction(*tx)
+		}
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		logger.DebugLogger.Printf("Rejected transaction: %s: %v", tx.Hash, err)
+		return false, err
+	}
+
+	if added {
 		s.Comms.BroadcastTransaction(tx)
 		logger.DebugLogger.Printf("Transaction processed: %s", tx.Hash)
 		return true, nil
@@ -47,7 +82,7 @@ func (s *BlockchainServer) HandleTransactionSubmission(tx *blockchain.Transactio
 	return false, fmt.Errorf("transaction already in the pool or blockchain")
 }
 
-func (s *BlockchainServer) HandleBlockSubmission(block *blockchain.Block, hashes *[]string, peerAddr string) (bool, error) {
+func (s *BlockchainServer) HandleBlockSubmission(block *blockchain.Block, peerAddr string) (bool, error) {
 	// 1) If peer is blacklisted, reject immediately
 	if s.PeerManager.IsBlacklisted(peerAddr) {
 		return false, fmt.Errorf("peer %s is blacklisted", peerAddr)
@@ -66,55 +101,182 @@ func (s *BlockchainServer) HandleBlockSubmission(block *blockchain.Block, hashes
 		return false, fmt.Errorf("invalid block by peer %s", peerAddr)
 	}
 
-	lastBlock := s.Blockchain.GetLastBlock()
-	if block.Header.PreviousHash == lastBlock.Hash {
-		if err := s.Blockchain.AddBlock(block); err != nil {
-			logger.ErrorLogger.Printf("[SubmitBlock] Failed to add block to main chain, hash: %s, Error: %v", block.Hash, err)
-			return false, fmt.Errorf("failed to add block to the main chain: %v", err)
-		}
+	reorg, err := s.processBlock(block)
+	if err == blockchain.ErrDuplicateBlock {
+		logger.DebugLogger.Printf("Duplicate block: %s", block.Hash)
+		return false, fmt.Errorf("block already in the blockchain")
+	}
 
+	// We are behind: sync with the peers in the background, the orphan is
+	// connected as soon as its ancestors are
+	if err == blockchain.ErrOrphanBlock {
+		logger.InfoLogger.Printf("[SubmitBlock] Orphan block %s kept, syncing missing ancestors", block.Hash)
+		go s.Sync()
+		return true, nil
+	}
+	if err != nil {
+		logger.ErrorLogger.Printf("[SubmitBlock] Failed to process block, hash: %s, Error: %v", block.Hash, err)
+		return false, fmt.Errorf("failed to process block: %v", err)
+	}
+
+	if reorg != nil && len(reorg.Removed) == 0 && len(reorg.Added) == 1 {
 		// Log time difference between blocks
-		prevBlock := s.Blockchain.GetBlockByHash(block.Header.PreviousHash)
+		prevBlock := s.GetKnownBlock(block.Header.PreviousHash)
 		if prevBlock != nil {
 			timeDiff := float64(block.Header.Timestamp-prevBlock.Header.Timestamp) / 1000.0
 			logger.InfoLogger.Printf("Block time difference: %.1fs (Height=%d)", timeDiff, block.Header.Height)
 		}
-
-		s.Comms.BroadcastBlock(block, *hashes)
-		logger.InfoLogger.Printf("Block received and added: %s", block.Hash)
-		return true, nil
 	}
 
-	if s.Blockchain.GetBlockByHash(block.Hash) != nil {
-		logger.DebugLogger.Printf("Duplicate block: %s", block.Hash)
-		return false, fmt.Errorf("block already in the blockchain")
+	s.Comms.BroadcastBlock(block)
+	logger.InfoLogger.Printf("Block received and processed: %s", block.Hash)
+	return true, nil
+}
+
+// HandleCompactBlock rebuilds a compact block from the mempool and handles it
+// like a submitted block. If transactions are missing it returns their
+// positions, for the peer to send them.
+func (s *BlockchainServer) HandleCompactBlock(cb *blockchain.CompactBlock, peerAddr string) (bool, []int, error) {
+	if s.PeerManager.IsBlacklisted(peerAddr) {
+		return false, nil, fmt.Errorf("peer %s is blacklisted", peerAddr)
+	}
+	if !s.WantsInventory(true, cb.Hash) {
+		logger.DebugLogger.Printf("Duplicate compact block: %s", cb.Hash)
+		return false, nil, fmt.Errorf("block already in the blockchain")
 	}
 
-	err := s.Blockchain.HandleFork(*hashes, s.Comms.RequestBlockByHash)
+	s.mu.RLock()
+	block, missing, err := cb.Reconstruct(s.TxPool)
+	s.mu.RUnlock()
 	if err != nil {
-		logger.ErrorLogger.Printf("[SubmitBlock] Fork handling error for block hash: %s, Error: %v", block.Hash, err)
-		return false, fmt.Errorf("fork handling error: %v", err)
+		s.PeerManager.IncrementInvalidCount(peerAddr)
+		logger.InfoLogger.Printf("Invalid compact block: %s from %s: %v", cb.Hash, peerAddr, err)
+		return false, nil, err
+	}
+	if len(missing) > 0 {
+		logger.DebugLogger.Printf("Compact block %s misses %d of %d transactions", cb.Hash, len(missing), cb.TransactionCount())
+		return false, missing, nil
 	}
 
-	s.Comms.BroadcastBlock(block, *hashes)
-	logger.DebugLogger.Printf("Fork resolved: %s", block.Hash)
-	return true, nil
+	accepted, err := s.HandleBlockSubmission(block, peerAddr)
+	return accepted, nil, err
+}
+
+// processBlock hands a block the caller checked with Verify, outside of the
+// lock, to the chain and updates the mempool accordingly.
+func (s *BlockchainServer) processBlock(block *blockchain.Block) (*blockchain.Reorg, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reorg, err := s.Blockchain.ProcessVerifiedBlock(block)
+	s.applyReorg(reorg)
+	return reorg, err
+}
+
+// applyReorg updates the mempool after the main chain changed. The caller must
+// hold the write lock.
+func (s *BlockchainServer) applyReorg(reorg *blockchain.Reorg) {
+	if reorg == nil {
+		return
+	}
+	s.TxPool.HandleStaleBlocks(reorg.Removed, s.Blockchain.UTXOSet)
+	s.TxPool.HandleConnectedBlocks(reorg.Added)
+	if len(reorg.Removed) > 0 {
+		logger.InfoLogger.Printf("Reorganized %d stale blocks, mempool size: %d", len(reorg.Removed), len(s.TxPool.Transactions))
+	}
+
+	invalid := s.TxPool.Revalidate(s.Blockchain.UTXOSet)
+	expired := s.TxPool.Expire(time.Now())
+	if invalid > 0 || expired > 0 {
+		logger.DebugLogger.Printf("Evicted %d invalid and %d expired transactions from the mempool", invalid, expired)
+	}
+}
+
+// MempoolStats returns a summary of the transaction pool.
+func (s *BlockchainServer) MempoolStats() blockchain.PoolStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.TxPool.Stats()
+}
+
+// WantsInventory reports whether the announced block or transaction is new to
+// this node.
+func (s *BlockchainServer) WantsInventory(isBlock bool, hash string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if isBlock {
+		return !s.Blockchain.HasBlock(hash)
+	}
+	return !s.TxPool.HasTransaction(hash) && !s.Blockchain.HasTransaction(hash)
+}
+
+// GetKnownBlock returns a valid block from the main chain or a side branch.
+func (s *BlockchainServer) GetKnownBlock(hash string) *blockchain.Block {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Blockchain.GetKnownBlock(hash)
+}
+
+func (s *BlockchainServer) GetTransactionDepth(txHash string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Blockchain.GetTransactionDepth(txHash)
+}
+
+// GetMerkleProof returns a proof that a main chain transaction is part of its
+// block, with that block.
+func (s *BlockchainServer) GetMerkleProof(txHash string) (*blockchain.MerkleProof, *blockchain.Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Blockchain.GetMerkleProof(txHash)
+}
+
+// GetHeaders returns the main chain headers following the newest block of
+// locator on the main chain, at most blockchain.MaxHeadersPerRequest.
+func (s *BlockchainServer) GetHeaders(locator []string, stopHash string) []blockchain.BlockHeader {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Blockchain.LocateHeaders(locator, stopHash, blockchain.MaxHeadersPerRequest)
+}
+
+func (s *BlockchainServer) tipHeight() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Blockchain.GetLastBlock().Header.Height
 }
 
 func (s *BlockchainServer) createBlockWithTransactions() (*blockchain.Block, error) {
 	for {
-		transactions := s.TxPool.GetUpToNTransactions(1, s.Blockchain.UTXOSet)
+		s.mu.RLock()
+		transactions := s.TxPool.GetBlockTemplate(s.Blockchain.UTXOSet, s.BlockSizeLimit)
 		if len(transactions) > 0 {
-			block, err := s.Blockchain.CreateBlock(transactions)
+			block, err := s.Blockchain.CreateBlock(s.rewardAddress, transactions)
+			s.mu.RUnlock()
 			return block, err
 		}
+		s.mu.RUnlock()
 		time.Sleep(1 * time.Second)
 	}
 }
 
+// addMinedBlock connects a block mined by this node.
+func (s *BlockchainServer) addMinedBlock(block *blockchain.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.Blockchain.AddBlock(block); err != nil {
+		return err
+	}
+	s.applyReorg(&blockchain.Reorg{Added: []*blockchain.Block{block}})
+	return nil
+}
+
 func (s *BlockchainServer) MineBlocks() error {
 	logger.InfoLogger.Println("Mining started")
 
+	s.miningMu.Lock()
+	defer s.miningMu.Unlock()
+
 	if s.mining {
 		logger.DebugLogger.Println("Mining already in progress")
 		return fmt.Errorf("mining is already in progress")
@@ -125,11 +287,6 @@ func (s *BlockchainServer) MineBlocks() error {
 	s.mining = true
 
 	go func() {
-		defer func() {
-			s.mining = false
-			s.cancelFunc = nil
-		}()
-
 		for {
 			select {
 			case <-mineCtx.Done():
@@ -156,7 +313,7 @@ func (s *BlockchainServer) MineBlocks() error {
 
 					if block.Header.Nonce%10000 == 0 {
 						logger.DebugLogger.Printf("Mining progress: Height=%d, Nonce=%d", block.Header.Height, block.Header.Nonce)
-						if block.Header.Height <= s.Blockchain.GetLastBlock().Header.Height {
+						if block.Header.Height <= s.tipHeight() {
 							logger.DebugLogger.Printf("Chain advanced while mining: Height=%d", block.Header.Height)
 							block, err = s.createBlockWithTransactions()
 							if err != nil {
@@ -173,7 +330,7 @@ func (s *BlockchainServer) MineBlocks() error {
 
 				block.Hash = hash
 
-				if block.Header.Height <= s.Blockchain.GetLastBlock().Header.Height {
+				if block.Header.Height <= s.tipHeight() {
 					logger.DebugLogger.Println("Chain advanced, restarting mining")
 					continue
 				}
@@ -197,7 +354,7 @@ func (s *BlockchainServer) MineBlocks() error {
 				case 3:
 					// Fork mode - don't broadcast until 5th block
 					if block.Header.Height > 1 && block.Header.Height < 5 {
-						if err := s.Blockchain.AddBlock(block); err != nil {
+						if err := s.addMinedBlock(block); err != nil {
 							logger.ErrorLogger.Printf("[MineBlocks] Error adding block: %v", err)
 							continue
 						}
@@ -206,13 +363,13 @@ func (s *BlockchainServer) MineBlocks() error {
 					}
 				}
 
-				if err := s.Blockchain.AddBlock(block); err != nil && s.mode == 0 {
+				if err := s.addMinedBlock(block); err != nil && s.mode == 0 {
 					logger.ErrorLogger.Printf("[MineBlocks] Error adding block: %v", err)
 					continue
 				}
 
 				// Log time difference between blocks
-				prevBlock := s.Blockchain.GetBlockByHash(block.Header.PreviousHash)
+				prevBlock := s.GetKnownBlock(block.Header.PreviousHash)
 				if prevBlock != nil {
 					timeDiff := float64(block.Header.Timestamp-prevBlock.Header.Timestamp) / 1000.0
 					logger.InfoLogger.Printf("Block time difference: %.1fs (Height=%d)", timeDiff, block.Header.Height)
@@ -222,7 +379,7 @@ func (s *BlockchainServer) MineBlocks() error {
 
 				// Don't broadcast in fork mode until 5th block
 				if s.mode != 3 || block.Header.Height == 1 || block.Header.Height >= 5 {
-					s.Comms.BroadcastBlock(block, s.Blockchain.GetLast100Hashes())
+					s.Comms.BroadcastBlock(block)
 					logger.DebugLogger.Printf("Block broadcasted: Height=%d, Hash=%s", block.Header.Height, block.Hash)
 				}
 
@@ -241,12 +398,16 @@ func (s *BlockchainServer) MineBlocks() error {
 func (s *BlockchainServer) StopMining() error {
 	logger.InfoLogger.Println("Mining stop requested")
 
+	s.miningMu.Lock()
+	defer s.miningMu.Unlock()
+
 	if !s.mining {
 		logger.DebugLogger.Println("Mining not active")
 		return fmt.Errorf("mining is not active")
 	}
 
 	s.cancelFunc()
+	s.cancelFunc = nil
 	s.mining = false
 	logger.InfoLogger.Println("Mining stopped successfully")
 
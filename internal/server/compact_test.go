@@ -0,0 +1,87 @@
+package server
+
+import (
+	"nakamoto-blockchain/internal/blockchain"
+	"nakamoto-blockchain/proto/gen"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// serve starts a gRPC server for node on a free local port and returns its
+// address.
+func serve(t *testing.T, node *BlockchainServer) string {
+	t.Helper()
+	return serveService(t, &IncomingCommunicator{Node: node})
+}
+
+// serveService is serve for any implementation of the peer service.
+func serveService(t *testing.T, service gen.IncomingCommunicatorServiceServer) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	gen.RegisterIncomingCommunicatorServiceServer(grpcServer, service)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	return listener.Addr().String()
+}
+
+// A block is relayed as a compact block, the peer asking only for the
+// transaction missing from its pool.
+func TestBroadcastBlockRelaysCompactBlock(t *testing.T) {
+	priv, pub, addr := newTestKey(t)
+	utxos := []blockchain.UTXO{
+		{TxID: "aa", Index: 0, Amount: 50, Address: addr},
+		{TxID: "bb", Index: 0, Amount: 50, Address: addr},
+	}
+	sender, receiver := newTestServer(utxos, addr), newTestServer(utxos, addr)
+	receiverAddr := serve(t, receiver)
+
+	var txs []blockchain.Transaction
+	for i, utxo := range utxos {
+		tx, err := blockchain.NewTransaction([]blockchain.UTXO{utxo}, pub, pub, 10, int64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Sign(priv); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, *tx)
+	}
+	if accepted, err := receiver.HandleTransactionSubmission(&txs[0]); !accepted {
+		t.Fatal(err)
+	}
+	sender.PeerManager.AddPeers([]string{receiverAddr})
+	defer sender.PeerManager.RemovePeer(receiverAddr)
+
+	block, err := sender.Blockchain.CreateBlock("miner", txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.processBlock(mine(t, block)); err != nil {
+		t.Fatal(err)
+	}
+
+	sender.Comms.BroadcastBlock(block)
+	if receiver.tipHeight() != 1 || receiver.Blockchain.GetLastBlock().Hash != block.Hash {
+		t.Fatal("block not relayed")
+	}
+	if receiver.TxPool.HasTransaction(txs[0].Hash) {
+		t.Fatal("mined transaction left in the pool")
+	}
+	if !sender.PeerManager.HasKnownInventory(receiverAddr, block.Hash) {
+		t.Fatal("relayed block not known to the peer")
+	}
+
+	compact, err := blockchain.NewCompactBlock(block, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := receiver.HandleCompactBlock(compact, "peer"); err == nil {
+		t.Fatal("known compact block accepted again")
+	}
+}
@@ -8,10 +8,12 @@ import (
 // ConvertUTXOToGrpc Converts a UTXO to a grpc UTXO.
 func ConvertUTXOToGrpc(utxo *blockchain.UTXO) *gen.UTXO {
 	return &gen.UTXO{
-		TxHash:  utxo.TxID,
-		Index:   int32(utxo.Index),
-		Amount:  utxo.Amount,
-		Address: utxo.Address,
+		TxHash:     utxo.TxID,
+		Index:      int32(utxo.Index),
+		Amount:     utxo.Amount,
+		Address:    utxo.Address,
+		LockScript: utxo.LockScript,
+		LockTime:   utxo.LockTime,
 	}
 }
 
@@ -27,6 +29,11 @@ func ConvertTransactionToGrpc(tx *blockchain.Transaction) *gen.Transaction {
 		grpcOutputs[i] = ConvertUTXOToGrpc(&output)
 	}
 
+	grpcWitnesses := make([]*gen.InputWitness, len(tx.Witnesses))
+	for i, witness := range tx.Witnesses {
+		grpcWitnesses[i] = &gen.InputWitness{Pubkey: witness.PubKey, Signature: witness.Signature, UnlockScript: witness.UnlockScript}
+	}
+
 	return &gen.Transaction{
 		Inputs:     grpcInputs,
 		Outputs:    grpcOutputs,
@@ -34,6 +41,10 @@ func ConvertTransactionToGrpc(tx *blockchain.Transaction) *gen.Transaction {
 		Signature:  tx.Signature,
 		Hash:       tx.Hash,
 		Senderpubkey: tx.Content.SenderPubKey,
+		Height:     int32(tx.Content.Height),
+		Witnesses:  grpcWitnesses,
+		LockTime:   tx.Content.LockTime,
+		Version:    int32(tx.Content.Version),
 	}
 }
 
@@ -46,6 +57,7 @@ func ConvertBlockToGrpc(block *blockchain.Block) *gen.Block {
 		Height:       int32(block.Header.Height),
 		Difficulty:   block.Header.Difficulty,
 		Nonce:        block.Header.Nonce,
+		Version:      int32(block.Header.Version),
 	}
 
 	grpcTransactions := make([]*gen.Transaction, len(block.Content.Transactions))
@@ -77,6 +89,7 @@ func ConvertBlockHeadersToGrpc(blockHeaders []blockchain.BlockHeader) []*gen.Blo
 			Height:       int32(header.Height),
 			Difficulty:   header.Difficulty,
 			Nonce:        header.Nonce,
+			Version:      int32(header.Version),
 		}
 	}
 	return grpcBlockHeaders
@@ -85,10 +98,12 @@ func ConvertBlockHeadersToGrpc(blockHeaders []blockchain.BlockHeader) []*gen.Blo
 // ConvertGrpcToUTXO Converts a grpc UTXO to a UTXO.
 func ConvertGrpcToUTXO(grpcUTXO *gen.UTXO) *blockchain.UTXO {
 	return &blockchain.UTXO{
-		TxID:    grpcUTXO.TxHash,
-		Index:   int(grpcUTXO.Index),
-		Amount:  grpcUTXO.Amount,
-		Address: grpcUTXO.Address,
+		TxID:       grpcUTXO.TxHash,
+		Index:      int(grpcUTXO.Index),
+		Amount:     grpcUTXO.Amount,
+		Address:    grpcUTXO.Address,
+		LockScript: grpcUTXO.LockScript,
+		LockTime:   grpcUTXO.LockTime,
 	}
 }
 
@@ -112,15 +127,24 @@ func ConvertGrpcToTransaction(grpcTx *gen.Transaction) *blockchain.Transaction {
 		outputUTXOs[i] = *ConvertGrpcToUTXO(output)
 	}
 
+	var witnesses []blockchain.InputWitness
+	for _, witness := range grpcTx.Witnesses {
+		witnesses = append(witnesses, blockchain.InputWitness{PubKey: witness.Pubkey, Signature: witness.Signature, UnlockScript: witness.UnlockScript})
+	}
+
 	return &blockchain.Transaction{
 		Content: blockchain.TransactionContent{
 			InputUTXOs:  inputUTXOs,
 			OutputUTXOs: outputUTXOs,
 			Timestamp:   grpcTx.Timestamp,
 			SenderPubKey: grpcTx.Senderpubkey,
+			Height:      int(grpcTx.Height),
+			LockTime:    grpcTx.LockTime,
+			Version:     int(grpcTx.Version),
 		},
 		Signature: grpcTx.Signature,
 		Hash:      grpcTx.Hash,
+		Witnesses: witnesses,
 	}
 }
 
@@ -133,6 +157,7 @@ func ConvertGrpcToBlock(grpcBlock *gen.Block) *blockchain.Block {
 		Height:       int(grpcBlock.Header.Height),
 		Difficulty:   grpcBlock.Header.Difficulty,
 		Nonce:        grpcBlock.Header.Nonce,
+		Version:      int(grpcBlock.Header.Version),
 	}
 
 	transactions := make([]blockchain.Transaction, len(grpcBlock.Content.Transactions))
@@ -162,7 +187,74 @@ func ConvertGrpcHeadersToBlockHeaders(grpcHeaders []*gen.BlockHeader) []blockcha
 			Height:       int(header.Height),
 			Difficulty:   header.Difficulty,
 			Nonce:        header.Nonce,
+			Version:      int(header.Version),
 		}
 	}
 	return headers
 }
+
+// ConvertMerkleProofToGrpc Converts a Merkle proof and the block it refers to to a grpc Merkle proof.
+func ConvertMerkleProofToGrpc(proof *blockchain.MerkleProof, block *blockchain.Block) *gen.MerkleProofResponse {
+	return &gen.MerkleProofResponse{
+		Header:    ConvertBlockHeadersToGrpc([]blockchain.BlockHeader{block.Header})[0],
+		BlockHash: block.Hash,
+		Index:     int32(proof.Index),
+		Count:     int32(proof.Count),
+		Siblings:  proof.Siblings,
+	}
+}
+
+// ConvertGrpcToMerkleProof Converts a grpc Merkle proof to a Merkle proof for txHash and the header it refers to.
+func ConvertGrpcToMerkleProof(txHash string, grpcProof *gen.MerkleProofResponse) (*blockchain.MerkleProof, *blockchain.BlockHeader) {
+	proof := &blockchain.MerkleProof{
+		TxHash:   txHash,
+		Index:    int(grpcProof.Index),
+		Count:    int(grpcProof.Count),
+		Siblings: grpcProof.Siblings,
+	}
+	if grpcProof.Header == nil {
+		return proof, nil
+	}
+	header := ConvertGrpcHeadersToBlockHeaders([]*gen.BlockHeader{grpcProof.Header})[0]
+	return proof, &header
+}
+
+// ConvertCompactBlockToGrpc Converts a compact block to a grpc compact block.
+func ConvertCompactBlockToGrpc(cb *blockchain.CompactBlock) *gen.CompactBlock {
+	prefilled := make([]*gen.PrefilledTransaction, len(cb.Prefilled))
+	for i, p := range cb.Prefilled {
+		prefilled[i] = &gen.PrefilledTransaction{
+			Index:       int32(p.Index),
+			Transaction: ConvertTransactionToGrpc(&p.Transaction),
+		}
+	}
+	return &gen.CompactBlock{
+		Header:    ConvertBlockHeadersToGrpc([]blockchain.BlockHeader{cb.Header})[0],
+		Hash:      cb.Hash,
+		Nonce:     cb.Nonce,
+		ShortIds:  cb.ShortIDs,
+		Prefilled: prefilled,
+	}
+}
+
+// ConvertGrpcToCompactBlock Converts a grpc compact block to a compact block.
+func ConvertGrpcToCompactBlock(grpcBlock *gen.CompactBlock) *blockchain.CompactBlock {
+	cb := &blockchain.CompactBlock{
+		Hash:     grpcBlock.Hash,
+		Nonce:    grpcBlock.Nonce,
+		ShortIDs: grpcBlock.ShortIds,
+	}
+	if grpcBlock.Header != nil {
+		cb.Header = ConvertGrpcHeadersToBlockHeaders([]*gen.BlockHeader{grpcBlock.Header})[0]
+	}
+	for _, p := range grpcBlock.Prefilled {
+		if p.Transaction == nil {
+			continue
+		}
+		cb.Prefilled = append(cb.Prefilled, blockchain.PrefilledTransaction{
+			Index:       int(p.Index),
+			Transaction: *ConvertGrpcToTransaction(p.Transaction),
+		})
+	}
+	return cb
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"nakamoto-blockchain/internal/blockchain"
+	"nakamoto-blockchain/internal/crypto"
+	"nakamoto-blockchain/logger"
+	"os"
+	"testing"
+)
+
+func init() {
+	logger.Init(os.DevNull)
+}
+
+// newTestKey returns a private key, its public key and its address.
+func newTestKey(t *testing.T) (string, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	privBytes, _ := x509.MarshalECPrivateKey(key)
+	pub := base64.StdEncoding.EncodeToString(pubBytes)
+	return base64.StdEncoding.EncodeToString(privBytes), pub, crypto.Key2Addr(pub)
+}
+
+func newTestServer(utxos []blockchain.UTXO, rewardAddress string) *BlockchainServer {
+	peerManager := NewPeerManager()
+	return NewBlockchainServer(OutgoingCommunicator{PeerManager: peerManager}, peerManager, blockchain.NewBlockchain(utxos), 0, rewardAddress)
+}
+
+// mine finds a nonce meeting the block's difficulty and sets its hash.
+func mine(t *testing.T, block *blockchain.Block) *blockchain.Block {
+	t.Helper()
+	for {
+		hash, err := block.CalculateHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.VerifyHash(hash) {
+			block.Hash = hash
+			return block
+		}
+		block.Header.Nonce++
+	}
+}
+
+// mineOnTip mines an empty block on the tip of node and processes it.
+func mineOnTip(t *testing.T, node *BlockchainServer) *blockchain.Block {
+	t.Helper()
+	block, err := node.Blockchain.CreateBlock(node.rewardAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.processBlock(mine(t, block)); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
@@ -13,7 +13,7 @@ type IncomingCommunicator struct {
 	Node *BlockchainServer
 }
 
-func (s *IncomingCommunicator) SubmitBlock(ctx context.Context, block *gen.BlockWithHashes) (*gen.BlockResponse, error) {
+func (s *IncomingCommunicator) SubmitBlock(ctx context.Context, block *gen.BlockSubmission) (*gen.BlockResponse, error) {
 	// EXTRACT PEER IP ADDRESS
 	peerAddr := "unknownPeer"
     if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
@@ -28,8 +28,7 @@ func (s *IncomingCommunicator) SubmitBlock(ctx context.Context, block *gen.Block
 	}
 
 	blk := ConvertGrpcToBlock(block.Block)
-	hashes := block.Last_100Hashes
-	res, err := s.Node.HandleBlockSubmission(blk, &hashes, peerAddr)
+	res, err := s.Node.HandleBlockSubmission(blk, peerAddr)
 
 	var errorMsg string
 	if err != nil {
@@ -56,7 +55,7 @@ func (s *IncomingCommunicator) SubmitTransaction(ctx context.Context, tx *gen.Tr
 
 func (s *IncomingCommunicator) GetBlockByHash(ctx context.Context, req *gen.BlockRequest) (*gen.Block, error) {
 	logger.InfoLogger.Println("[GetBlock] Called with hash:", req.Hash)
-	block := s.Node.Blockchain.GetBlockByHash(req.Hash)
+	block := s.Node.GetKnownBlock(req.Hash)
 
 	if block == nil {
 		logger.InfoLogger.Println("[GetBlock] Block not found for hash:", req.Hash)
@@ -71,7 +70,7 @@ func (s *IncomingCommunicator) GetTransactionStatus(ctx context.Context, req *ge
     txHash := req.Hash
     k := req.K
 
-	depth := int32(s.Node.Blockchain.GetTransactionDepth(txHash))
+	depth := int32(s.Node.GetTransactionDepth(txHash))
     isConfirmed := false
 
 	if depth >= k {
@@ -89,3 +88,57 @@ func (s *IncomingCommunicator) GetTransactionStatus(ctx context.Context, req *ge
         Error:     "",
     }, nil
 }
+
+func (s *IncomingCommunicator) GetMerkleProof(ctx context.Context, req *gen.MerkleProofRequest) (*gen.MerkleProofResponse, error) {
+	proof, block, err := s.Node.GetMerkleProof(req.TxHash)
+	if err != nil {
+		logger.DebugLogger.Printf("[GetMerkleProof] No proof for transaction %s: %v", req.TxHash, err)
+		return &gen.MerkleProofResponse{Error: err.Error()}, nil
+	}
+	return ConvertMerkleProofToGrpc(proof, block), nil
+}
+
+func (s *IncomingCommunicator) GetHeaders(ctx context.Context, req *gen.HeadersRequest) (*gen.HeadersResponse, error) {
+	headers := s.Node.GetHeaders(req.Locator, req.StopHash)
+	logger.DebugLogger.Printf("[GetHeaders] Returning %d headers for a locator of %d hashes", len(headers), len(req.Locator))
+	return &gen.HeadersResponse{Headers: ConvertBlockHeadersToGrpc(headers)}, nil
+}
+
+// Announce answers an inventory announcement with the hashes of the items this
+// node does not have, which the announcing peer then submits.
+func (s *IncomingCommunicator) Announce(ctx context.Context, inv *gen.Inventory) (*gen.InventoryResponse, error) {
+	response := &gen.InventoryResponse{}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil && s.Node.PeerManager.IsBlacklisted(p.Addr.String()) {
+		return response, nil
+	}
+
+	for _, item := range inv.Items {
+		if s.Node.WantsInventory(item.Type == gen.InventoryType_INV_BLOCK, item.Hash) {
+			response.Wanted = append(response.Wanted, item.Hash)
+		}
+	}
+	logger.DebugLogger.Printf("[Announce] Wanted %d of %d announced items", len(response.Wanted), len(inv.Items))
+	return response, nil
+}
+
+// SubmitCompactBlock handles a block sent as a compact block. If the node
+// misses some of its transactions, the response lists them and the block is
+// not processed until they are sent.
+func (s *IncomingCommunicator) SubmitCompactBlock(ctx context.Context, block *gen.CompactBlock) (*gen.CompactBlockResponse, error) {
+	peerAddr := "unknownPeer"
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		peerAddr = p.Addr.String()
+	}
+	logger.DebugLogger.Println("[SubmitCompactBlock] Called with block hash:", block.Hash, "from:", peerAddr)
+
+	res, missing, err := s.Node.HandleCompactBlock(ConvertGrpcToCompactBlock(block), peerAddr)
+	response := &gen.CompactBlockResponse{Accepted: res}
+	for _, index := range missing {
+		response.Missing = append(response.Missing, int32(index))
+	}
+	if err != nil {
+		response.Error = err.Error()
+		logger.DebugLogger.Printf("[SubmitCompactBlock] Block %s failed: %v", block.Hash, err)
+	}
+	return response, err
+}
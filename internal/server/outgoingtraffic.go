@@ -2,12 +2,21 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"nakamoto-blockchain/internal/blockchain"
 	"nakamoto-blockchain/logger"
 	"nakamoto-blockchain/proto/gen"
 	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// Time allowed for a single request to a peer while syncing
+const peerRequestTimeout = 10 * time.Second
+
 type OutgoingCommunicator struct {
 	PeerManager *PeerManager
 }
@@ -15,7 +24,8 @@ type OutgoingCommunicator struct {
 func (s *OutgoingCommunicator) BroadcastTransaction(tx *blockchain.Transaction) {
 	logger.DebugLogger.Println("[BroadcastTransaction] Called with transaction hash:", tx.Hash)
 
-	for _, client := range s.PeerManager.ListPeerClients() {
+	item := &gen.InventoryItem{Type: gen.InventoryType_INV_TRANSACTION, Hash: tx.Hash}
+	s.announce(item, func(client gen.IncomingCommunicatorServiceClient) {
 		_, err := client.SubmitTransaction(context.Background(), ConvertTransactionToGrpc(tx))
 		if err != nil {
 			if strings.Contains(err.Error(), "already") {
@@ -24,25 +34,81 @@ func (s *OutgoingCommunicator) BroadcastTransaction(tx *blockchain.Transaction)
 				logger.WarnLogger.Printf("[BroadcastTransaction] Error broadcasting transaction: %v", err)
 			}
 		}
-	}
+	})
 
 	logger.DebugLogger.Println("[BroadcastTransaction] Completed for hash:", tx.Hash)
 }
 
-func (s *OutgoingCommunicator) BroadcastBlock(block *blockchain.Block, hashes []string) {
+func (s *OutgoingCommunicator) BroadcastBlock(block *blockchain.Block) {
 	logger.DebugLogger.Println("[BroadcastBlock] Called with block hash:", block.Hash)
 
-	for _, client := range s.PeerManager.ListPeerClients() {
-		_, err := client.SubmitBlock(context.Background(), &gen.BlockWithHashes{
-			Block:          ConvertBlockToGrpc(block),
-			Last_100Hashes: hashes,
-		})
-		if err != nil {
-			logger.DebugLogger.Printf("[BroadcastBlock] Error broadcasting block: %v", err)
+	item := &gen.InventoryItem{Type: gen.InventoryType_INV_BLOCK, Hash: block.Hash}
+	s.announce(item, func(client gen.IncomingCommunicatorServiceClient) {
+		s.sendBlock(client, block)
+	})
+
+	logger.DebugLogger.Println("[BroadcastBlock] Completed for hash:", block.Hash)
+}
+
+// sendBlock sends block to a peer as a compact block, again with the
+// transactions the peer misses if any. Peers still unable to rebuild it, or not
+// knowing compact blocks, are sent the full block.
+func (s *OutgoingCommunicator) sendBlock(client gen.IncomingCommunicatorServiceClient, block *blockchain.Block) {
+	response, err := submitCompactBlock(client, block, nil)
+	if err == nil && len(response.Missing) > 0 {
+		missing := make([]int, len(response.Missing))
+		for i, index := range response.Missing {
+			missing[i] = int(index)
 		}
+		logger.DebugLogger.Printf("[BroadcastBlock] Peer misses %d transactions of block %s", len(missing), block.Hash)
+		response, err = submitCompactBlock(client, block, missing)
 	}
 
-	logger.DebugLogger.Println("[BroadcastBlock] Completed for hash:", block.Hash)
+	if errors.Is(err, errNoCompactBlock) || status.Code(err) == codes.Unimplemented || (err == nil && len(response.Missing) > 0) {
+		_, err = client.SubmitBlock(context.Background(), &gen.BlockSubmission{Block: ConvertBlockToGrpc(block)})
+	}
+	if err != nil {
+		logger.DebugLogger.Printf("[BroadcastBlock] Error broadcasting block: %v", err)
+	}
+}
+
+var errNoCompactBlock = errors.New("compact block unavailable")
+
+// submitCompactBlock sends block to a peer as a compact block, with the
+// transactions at the positions in prefill in full.
+func submitCompactBlock(client gen.IncomingCommunicatorServiceClient, block *blockchain.Block, prefill []int) (*gen.CompactBlockResponse, error) {
+	compact, err := blockchain.NewCompactBlock(block, prefill)
+	if err != nil {
+		logger.WarnLogger.Printf("[BroadcastBlock] Sending block %s in full: %v", block.Hash, err)
+		return nil, errNoCompactBlock
+	}
+	return client.SubmitCompactBlock(context.Background(), ConvertCompactBlockToGrpc(compact))
+}
+
+// announce offers item to every peer not known to have it yet, and sends it
+// with send to the peers asking for it.
+func (s *OutgoingCommunicator) announce(item *gen.InventoryItem, send func(client gen.IncomingCommunicatorServiceClient)) {
+	for _, address := range s.PeerManager.ListPeers() {
+		if s.PeerManager.HasKnownInventory(address, item.Hash) {
+			continue
+		}
+		client := s.PeerManager.PeerClient(address)
+		if client == nil {
+			continue
+		}
+
+		response, err := client.Announce(context.Background(), &gen.Inventory{Items: []*gen.InventoryItem{item}})
+		if err != nil {
+			logger.DebugLogger.Printf("[Announce] Error announcing %s to %s: %v", item.Hash, address, err)
+			continue
+		}
+
+		// Once sent, the peer has seen the item, whether or not it accepted it
+		if len(response.Wanted) > 0 {
+			send(client)
+		}
+		s.PeerManager.AddKnownInventory(address, item.Hash)
+	}
 }
 
 func (s *OutgoingCommunicator) RequestBlockByHash(hash string) *blockchain.Block {
@@ -60,3 +126,37 @@ func (s *OutgoingCommunicator) RequestBlockByHash(hash string) *blockchain.Block
 	logger.ErrorLogger.Println("[RequestBlockByHash] Block not found for hash:", hash)
 	return nil
 }
+
+// RequestHeaders asks the peer at address for the main chain headers following
+// the newest block of locator it knows.
+func (s *OutgoingCommunicator) RequestHeaders(address string, locator []string) ([]blockchain.BlockHeader, error) {
+	client := s.PeerManager.PeerClient(address)
+	if client == nil {
+		return nil, fmt.Errorf("unknown peer %s", address)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), peerRequestTimeout)
+	defer cancel()
+	response, err := client.GetHeaders(ctx, &gen.HeadersRequest{Locator: locator})
+	if err != nil {
+		return nil, err
+	}
+	return ConvertGrpcHeadersToBlockHeaders(response.Headers), nil
+}
+
+// RequestBlockFromPeer asks the peer at address for the block with the given
+// hash.
+func (s *OutgoingCommunicator) RequestBlockFromPeer(address, hash string) (*blockchain.Block, error) {
+	client := s.PeerManager.PeerClient(address)
+	if client == nil {
+		return nil, fmt.Errorf("unknown peer %s", address)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), peerRequestTimeout)
+	defer cancel()
+	blockResponse, err := client.GetBlockByHash(ctx, &gen.BlockRequest{Hash: hash})
+	if err != nil {
+		return nil, err
+	}
+	return ConvertGrpcToBlock(blockResponse), nil
+}
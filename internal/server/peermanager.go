@@ -14,11 +14,21 @@ import (
 
 const DefaultGRPCPort = 50051
 
+// Hashes remembered per peer as known to it, oldest forgotten first
+const maxKnownInventory = 10000
+
+// PeerManager keeps the connections to our peers and what we know about them,
+// including the inventory (block and transaction hashes) each peer is known to
+// have, so it is never announced to it again. Inventory is keyed on the address
+// we connect to, and only recorded from our own exchanges with that address:
+// what a peer announces to us arrives from another address and cannot be told
+// apart from another peer's announcements.
 type PeerManager struct {
 	mu           sync.Mutex
 	peerClients  map[string]*grpc.ClientConn
 	blacklisted  map[string]bool
 	invalidCount map[string]int
+	known        map[string]*inventorySet
 }
 
 func NewPeerManager() *PeerManager {
@@ -26,9 +36,28 @@ func NewPeerManager() *PeerManager {
 		peerClients:  make(map[string]*grpc.ClientConn),
 		blacklisted:  make(map[string]bool),
 		invalidCount: make(map[string]int),
+		known:        make(map[string]*inventorySet),
 	}
 }
 
+// inventorySet is a set of hashes bounded to maxKnownInventory entries.
+type inventorySet struct {
+	hashes map[string]bool
+	order  []string
+}
+
+func (set *inventorySet) add(hash string) {
+	if set.hashes[hash] {
+		return
+	}
+	if len(set.order) >= maxKnownInventory {
+		delete(set.hashes, set.order[0])
+		set.order = set.order[1:]
+	}
+	set.hashes[hash] = true
+	set.order = append(set.order, hash)
+}
+
 func (pm *PeerManager) AddPeer(address string) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
@@ -92,6 +121,7 @@ func (pm *PeerManager) RemovePeer(address string) {
 		logger.InfoLogger.Printf("Peer removed and connection closed: %s", address)
 	}
 	delete(pm.peerClients, address)
+	delete(pm.known, address)
 }
 
 func (pm *PeerManager) ListPeers() []string {
@@ -116,6 +146,42 @@ func (pm *PeerManager) ListPeerClients() []gen.IncomingCommunicatorServiceClient
 	return clients
 }
 
+// PeerClient returns the client of the peer with the given address, or nil if
+// it is not a peer.
+func (pm *PeerManager) PeerClient(address string) gen.IncomingCommunicatorServiceClient {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	conn, exists := pm.peerClients[address]
+	if !exists {
+		return nil
+	}
+	return gen.NewIncomingCommunicatorServiceClient(conn)
+}
+
+// AddKnownInventory records that the peer at address has the item with hash.
+func (pm *PeerManager) AddKnownInventory(address, hash string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	set, exists := pm.known[address]
+	if !exists {
+		set = &inventorySet{hashes: make(map[string]bool)}
+		pm.known[address] = set
+	}
+	set.add(hash)
+}
+
+// HasKnownInventory reports whether the peer at address is known to have the
+// item with hash.
+func (pm *PeerManager) HasKnownInventory(address, hash string) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	set, exists := pm.known[address]
+	return exists && set.hashes[hash]
+}
+
 func (pm *PeerManager) IsBlacklisted(address string) bool {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"nakamoto-blockchain/proto/gen"
+	"testing"
+)
+
+// Whatever an announcement claims, it must not stop us from announcing the
+// item to our peers.
+func TestAnnounceDoesNotMarkPeerInventory(t *testing.T) {
+	node := newTestServer(nil, "miner")
+	peer := "127.0.0.1:1"
+	if err := node.PeerManager.AddPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+	defer node.PeerManager.RemovePeer(peer)
+
+	incoming := &IncomingCommunicator{Node: node}
+	hash := "00ff"
+	response, err := incoming.Announce(context.Background(), &gen.Inventory{Items: []*gen.InventoryItem{{Type: gen.InventoryType_INV_TRANSACTION, Hash: hash}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Wanted) != 1 {
+		t.Fatalf("%d items wanted, want 1", len(response.Wanted))
+	}
+	if node.PeerManager.HasKnownInventory(peer, hash) {
+		t.Fatal("announcement marked the item as known to a peer")
+	}
+
+	node.PeerManager.AddKnownInventory(peer, hash)
+	if !node.PeerManager.HasKnownInventory(peer, hash) {
+		t.Fatal("item sent to the peer not known to it")
+	}
+	node.PeerManager.RemovePeer(peer)
+	if node.PeerManager.HasKnownInventory(peer, hash) {
+		t.Fatal("inventory kept for a removed peer")
+	}
+}
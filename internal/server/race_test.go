@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"nakamoto-blockchain/internal/blockchain"
+	"nakamoto-blockchain/proto/gen"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run with -race: transactions are submitted and the node is queried while it
+// mines.
+func TestConcurrentSubmissionsWhileMining(t *testing.T) {
+	priv, pub, addr := newTestKey(t)
+	var utxos []blockchain.UTXO
+	for i := 0; i < 32; i++ {
+		utxos = append(utxos, blockchain.UTXO{TxID: fmt.Sprint("funding", i), Index: 0, Amount: 10, Address: addr})
+	}
+	s := newTestServer(utxos, addr)
+	if err := s.MineBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopMining()
+
+	incoming := &IncomingCommunicator{Node: s}
+	genesis := s.GetKnownBlock(blockchain.GenesisBlock().Hash)
+	hashes := make(chan string, len(utxos))
+	var wg sync.WaitGroup
+	for i := range utxos {
+		wg.Add(1)
+		go func(utxo blockchain.UTXO) {
+			defer wg.Done()
+			tx, err := blockchain.NewTransaction([]blockchain.UTXO{utxo}, pub, pub, 5, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := tx.Sign(priv); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := s.HandleTransactionSubmission(tx); err != nil {
+				t.Errorf("transaction %s rejected: %v", tx.Hash, err)
+			}
+			hashes <- tx.Hash
+
+			s.GetTransactionDepth(tx.Hash)
+			s.WantsInventory(false, tx.Hash)
+			s.MempoolStats()
+			s.GetHeaders([]string{genesis.Hash}, "")
+			s.HandleBlockSubmission(genesis, "peer")
+			incoming.GetBlockByHash(context.Background(), &gen.BlockRequest{Hash: genesis.Hash})
+		}(utxos[i])
+	}
+	wg.Wait()
+	close(hashes)
+
+	deadline := time.Now().Add(5 * time.Minute)
+	for s.tipHeight() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("no block mined")
+		}
+		s.MempoolStats()
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := s.StopMining(); err != nil {
+		t.Fatal(err)
+	}
+
+	for hash := range hashes {
+		if s.WantsInventory(false, hash) {
+			t.Errorf("transaction %s neither pooled nor mined", hash)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"errors"
+	"math/big"
+	"nakamoto-blockchain/internal/blockchain"
+	"nakamoto-blockchain/logger"
+	"sync"
+)
+
+// Headers-first synchronisation. The node first asks every peer for the
+// headers of its main chain, starting from our block locator, and validates
+// them, including their proof of work. Only the chain of headers with the most
+// work, if it has more than our own chain, is then downloaded: block bodies are
+// fetched in parallel from all peers, a window at a time, and connected in
+// height order.
+const (
+	syncWindow         = 64 // blocks downloaded before they are connected
+	maxParallelFetches = 8  // block downloads in flight at once
+)
+
+// maxPendingHeaders is the number of headers kept from one peer in one sync.
+var maxPendingHeaders = 25 * blockchain.MaxHeadersPerRequest
+
+// headerChain is a validated chain of headers announced by a peer.
+type headerChain struct {
+	peer  string
+	nodes []*blockchain.BlockNode
+}
+
+func (c *headerChain) work() *big.Int {
+	return c.nodes[len(c.nodes)-1].ChainWork
+}
+
+// Sync catches up with the peer having the chain with the most work. Only one
+// sync runs at a time, other calls return immediately.
+func (s *BlockchainServer) Sync() {
+	s.syncMu.Lock()
+	if s.syncing {
+		s.syncMu.Unlock()
+		return
+	}
+	s.syncing = true
+	s.syncMu.Unlock()
+
+	defer func() {
+		s.syncMu.Lock()
+		s.syncing = false
+		s.syncMu.Unlock()
+	}()
+
+	peers := s.activePeers()
+	best := s.bestHeaderChain(peers)
+	if best == nil {
+		logger.DebugLogger.Println("[Sync] No peer has a chain with more work")
+		return
+	}
+
+	tip := best.nodes[len(best.nodes)-1]
+	logger.InfoLogger.Printf("[Sync] Downloading %d blocks up to height %d announced by %s", len(best.nodes), tip.Header.Height, best.peer)
+	connected := s.downloadBlocks(best.nodes, peers)
+	logger.InfoLogger.Printf("[Sync] Connected %d of %d blocks, tip height %d", connected, len(best.nodes), s.tipHeight())
+}
+
+func (s *BlockchainServer) activePeers() []string {
+	var peers []string
+	for _, peer := range s.PeerManager.ListPeers() {
+		if !s.PeerManager.IsBlacklisted(peer) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// bestHeaderChain fetches the header chains of all peers in parallel and
+// returns the one with the most work, or nil if none has more than ours.
+func (s *BlockchainServer) bestHeaderChain(peers []string) *headerChain {
+	chains := make([]*headerChain, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			chains[i] = s.fetchHeaderChain(peer)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	s.mu.RLock()
+	bestWork := s.Blockchain.ChainWork()
+	s.mu.RUnlock()
+
+	var best *headerChain
+	for _, chain := range chains {
+		if len(chain.nodes) > 0 && chain.work().Cmp(bestWork) > 0 {
+			best, bestWork = chain, chain.work()
+		}
+	}
+	return best
+}
+
+// fetchHeaderChain requests headers from peer until it has sent all of them or
+// maxPendingHeaders, validating each batch. A peer sending invalid headers is
+// penalised and its headers up to the invalid batch are kept. A branch that
+// reaches the height of our tip without more work than our chain, or that
+// fills maxPendingHeaders without it, is not worth following and is dropped,
+// so a peer cannot keep us fetching a long cheap chain.
+func (s *BlockchainServer) fetchHeaderChain(peer string) *headerChain {
+	s.mu.RLock()
+	locator := s.Blockchain.BlockLocator()
+	tipHeight, tipWork := s.Blockchain.GetLastBlock().Header.Height, s.Blockchain.ChainWork()
+	s.mu.RUnlock()
+
+	chain := &headerChain{peer: peer}
+	var last *blockchain.BlockNode
+	for {
+		headers, err := s.Comms.RequestHeaders(peer, locator)
+		if err != nil {
+			logger.DebugLogger.Printf("[Sync] Failed to get headers from %s: %v", peer, err)
+			break
+		}
+		if len(headers) == 0 {
+			break
+		}
+		if len(headers) > blockchain.MaxHeadersPerRequest {
+			s.PeerManager.IncrementInvalidCount(peer)
+			logger.WarnLogger.Printf("[Sync] %s sent %d headers, more than %d", peer, len(headers), blockchain.MaxHeadersPerRequest)
+			break
+		}
+		if last != nil && headers[0].PreviousHash != last.Hash {
+			// The peer switched to another branch meanwhile
+			logger.DebugLogger.Printf("[Sync] Headers from %s no longer follow %s", peer, last.Hash)
+			break
+		}
+
+		s.mu.RLock()
+		nodes, err := s.Blockchain.CheckHeaders(headers, last)
+		s.mu.RUnlock()
+		if err != nil {
+			if errors.Is(err, blockchain.ErrBadHeaderChain) {
+				s.PeerManager.IncrementInvalidCount(peer)
+			}
+			logger.WarnLogger.Printf("[Sync] Rejected headers from %s: %v", peer, err)
+			break
+		}
+
+		chain.nodes = append(chain.nodes, nodes...)
+		if len(headers) < blockchain.MaxHeadersPerRequest {
+			break
+		}
+		last = nodes[len(nodes)-1]
+		if last.ChainWork.Cmp(tipWork) <= 0 && (last.Header.Height >= tipHeight || len(chain.nodes) >= maxPendingHeaders) {
+			logger.WarnLogger.Printf("[Sync] Headers from %s up to height %d do not have more work than our chain, dropping them", peer, last.Header.Height)
+			return &headerChain{peer: peer}
+		}
+		if len(chain.nodes) >= maxPendingHeaders {
+			logger.DebugLogger.Printf("[Sync] Got %d headers from %s, fetching the rest in the next sync", len(chain.nodes), peer)
+			break
+		}
+		locator = []string{last.Hash}
+	}
+	return chain
+}
+
+// downloadBlocks fetches and connects the blocks of nodes a window at a time,
+// stopping at the first block no peer delivers or that fails validation. It
+// returns the number of blocks connected.
+func (s *BlockchainServer) downloadBlocks(nodes []*blockchain.BlockNode, peers []string) int {
+	connected := 0
+	for start := 0; start < len(nodes); start += syncWindow {
+		end := start + syncWindow
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+
+		blocks := s.fetchBlocks(nodes[start:end], peers)
+		for i, block := range blocks {
+			if block == nil {
+				logger.WarnLogger.Printf("[Sync] Block %s unavailable from every peer", nodes[start+i].Hash)
+				return connected
+			}
+			if _, err := s.processBlock(block); err != nil && err != blockchain.ErrDuplicateBlock {
+				logger.WarnLogger.Printf("[Sync] Block %s rejected: %v", block.Hash, err)
+				return connected
+			}
+			connected++
+		}
+	}
+	return connected
+}
+
+// fetchBlocks downloads the blocks of nodes in parallel. Each block is asked
+// from the peers in turn, starting with a different one for each block to
+// spread the load, until one delivers it. Blocks no peer delivered are nil.
+func (s *BlockchainServer) fetchBlocks(nodes []*blockchain.BlockNode, peers []string) []*blockchain.Block {
+	blocks := make([]*blockchain.Block, len(nodes))
+	slots := make(chan struct{}, maxParallelFetches)
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		if known := s.GetKnownBlock(node.Hash); known != nil {
+			blocks[i] = known
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, hash string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			for j := range peers {
+				peer := peers[(i+j)%len(peers)]
+				block, err := s.Comms.RequestBlockFromPeer(peer, hash)
+				if err != nil {
+					logger.DebugLogger.Printf("[Sync] Failed to get block %s from %s: %v", hash, peer, err)
+					continue
+				}
+				if block.Hash != hash || !block.Verify() {
+					s.PeerManager.IncrementInvalidCount(peer)
+					logger.WarnLogger.Printf("[Sync] Invalid block %s from %s", hash, peer)
+					continue
+				}
+				s.PeerManager.AddKnownInventory(peer, hash)
+				blocks[i] = block
+				return
+			}
+		}(i, node.Hash)
+	}
+	wg.Wait()
+	return blocks
+}
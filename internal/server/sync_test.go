@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"nakamoto-blockchain/internal/blockchain"
+	"nakamoto-blockchain/proto/gen"
+	"testing"
+)
+
+// headerPeer answers every header request with the same headers.
+type headerPeer struct {
+	gen.UnimplementedIncomingCommunicatorServiceServer
+	headers []blockchain.BlockHeader
+}
+
+func (p *headerPeer) GetHeaders(ctx context.Context, req *gen.HeadersRequest) (*gen.HeadersResponse, error) {
+	return &gen.HeadersResponse{Headers: ConvertBlockHeadersToGrpc(p.headers)}, nil
+}
+
+// setHeaderLimits lowers the headers sent per request and kept per sync, so
+// that tests fill them with a few mined blocks.
+func setHeaderLimits(t *testing.T, perRequest, perSync int) {
+	oldPerRequest, oldPerSync := blockchain.MaxHeadersPerRequest, maxPendingHeaders
+	blockchain.MaxHeadersPerRequest, maxPendingHeaders = perRequest, perSync
+	t.Cleanup(func() {
+		blockchain.MaxHeadersPerRequest, maxPendingHeaders = oldPerRequest, oldPerSync
+	})
+}
+
+func invalidCount(pm *PeerManager, address string) int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.invalidCount[address]
+}
+
+func TestFetchHeaderChainRejectsOversizedResponse(t *testing.T) {
+	setHeaderLimits(t, 2, 10)
+	node := newTestServer(nil, "miner")
+	peer := serveService(t, &headerPeer{headers: make([]blockchain.BlockHeader, 3)})
+	node.PeerManager.AddPeers([]string{peer})
+	defer node.PeerManager.RemovePeer(peer)
+
+	if chain := node.fetchHeaderChain(peer); len(chain.nodes) != 0 {
+		t.Fatalf("%d headers kept from an oversized response", len(chain.nodes))
+	}
+	if invalidCount(node.PeerManager, peer) != 1 {
+		t.Fatal("peer sending too many headers not penalised")
+	}
+}
+
+func TestFetchHeaderChainLimits(t *testing.T) {
+	setHeaderLimits(t, 1, 2)
+	ahead := newTestServer(nil, "ahead")
+	var blocks []*blockchain.Block
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, mineOnTip(t, ahead))
+	}
+	peer := serve(t, ahead)
+
+	// A node on the genesis block keeps the first maxPendingHeaders headers and
+	// fetches the rest in the next sync
+	behind := newTestServer(nil, "behind")
+	behind.PeerManager.AddPeers([]string{peer})
+	defer behind.PeerManager.RemovePeer(peer)
+	chain := behind.bestHeaderChain([]string{peer})
+	if chain == nil || len(chain.nodes) != 2 || chain.nodes[0].Hash != blocks[0].Hash || chain.nodes[1].Hash != blocks[1].Hash {
+		t.Fatal("first two headers of the peer's chain not fetched")
+	}
+
+	// A full batch reaching the height of our tip without more work than our
+	// chain is dropped, without penalising the peer
+	rival := newTestServer(nil, "rival")
+	mineOnTip(t, rival)
+	rival.PeerManager.AddPeers([]string{peer})
+	defer rival.PeerManager.RemovePeer(peer)
+	if chain := rival.fetchHeaderChain(peer); len(chain.nodes) != 0 {
+		t.Fatalf("%d headers kept from a branch without more work", len(chain.nodes))
+	}
+	if invalidCount(rival.PeerManager, peer) != 0 {
+		t.Fatal("peer penalised for a valid branch")
+	}
+}
@@ -19,9 +19,14 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	IncomingCommunicatorService_GetBlockByHash_FullMethodName    = "/blockchain.IncomingCommunicatorService/GetBlockByHash"
-	IncomingCommunicatorService_SubmitTransaction_FullMethodName = "/blockchain.IncomingCommunicatorService/SubmitTransaction"
-	IncomingCommunicatorService_SubmitBlock_FullMethodName       = "/blockchain.IncomingCommunicatorService/SubmitBlock"
+	IncomingCommunicatorService_GetBlockByHash_FullMethodName       = "/blockchain.IncomingCommunicatorService/GetBlockByHash"
+	IncomingCommunicatorService_SubmitTransaction_FullMethodName    = "/blockchain.IncomingCommunicatorService/SubmitTransaction"
+	IncomingCommunicatorService_SubmitBlock_FullMethodName          = "/blockchain.IncomingCommunicatorService/SubmitBlock"
+	IncomingCommunicatorService_GetTransactionStatus_FullMethodName = "/blockchain.IncomingCommunicatorService/GetTransactionStatus"
+	IncomingCommunicatorService_GetMerkleProof_FullMethodName       = "/blockchain.IncomingCommunicatorService/GetMerkleProof"
+	IncomingCommunicatorService_GetHeaders_FullMethodName           = "/blockchain.IncomingCommunicatorService/GetHeaders"
+	IncomingCommunicatorService_Announce_FullMethodName             = "/blockchain.IncomingCommunicatorService/Announce"
+	IncomingCommunicatorService_SubmitCompactBlock_FullMethodName   = "/blockchain.IncomingCommunicatorService/SubmitCompactBlock"
 )
 
 // IncomingCommunicatorServiceClient is the client API for IncomingCommunicatorService service.
@@ -35,7 +40,19 @@ type IncomingCommunicatorServiceClient interface {
 	// Submit new transaction
 	SubmitTransaction(ctx context.Context, in *Transaction, opts ...grpc.CallOption) (*TxResponse, error)
 	// Submit new block
-	SubmitBlock(ctx context.Context, in *BlockWithHeaders, opts ...grpc.CallOption) (*BlockResponse, error)
+	SubmitBlock(ctx context.Context, in *BlockSubmission, opts ...grpc.CallOption) (*BlockResponse, error)
+	// Gets a transactions Status
+	GetTransactionStatus(ctx context.Context, in *TransactionStatusRequest, opts ...grpc.CallOption) (*TransactionStatusResponse, error)
+	// Gets a proof that a transaction is included in a main chain block
+	GetMerkleProof(ctx context.Context, in *MerkleProofRequest, opts ...grpc.CallOption) (*MerkleProofResponse, error)
+	// Gets the main chain headers following the newest block of a locator
+	GetHeaders(ctx context.Context, in *HeadersRequest, opts ...grpc.CallOption) (*HeadersResponse, error)
+	// Announces blocks and transactions by hash, the response lists the ones the
+	// receiver wants sent with SubmitCompactBlock or SubmitTransaction
+	Announce(ctx context.Context, in *Inventory, opts ...grpc.CallOption) (*InventoryResponse, error)
+	// Submits a block as its header and short transaction ids, the response lists
+	// the transactions the receiver could not find in its pool
+	SubmitCompactBlock(ctx context.Context, in *CompactBlock, opts ...grpc.CallOption) (*CompactBlockResponse, error)
 }
 
 type incomingCommunicatorServiceClient struct {
@@ -66,7 +83,7 @@ func (c *incomingCommunicatorServiceClient) SubmitTransaction(ctx context.Contex
 	return out, nil
 }
 
-func (c *incomingCommunicatorServiceClient) SubmitBlock(ctx context.Context, in *BlockWithHeaders, opts ...grpc.CallOption) (*BlockResponse, error) {
+func (c *incomingCommunicatorServiceClient) SubmitBlock(ctx context.Context, in *BlockSubmission, opts ...grpc.CallOption) (*BlockResponse, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(BlockResponse)
 	err := c.cc.Invoke(ctx, IncomingCommunicatorService_SubmitBlock_FullMethodName, in, out, cOpts...)
@@ -76,6 +93,56 @@ func (c *incomingCommunicatorServiceClient) SubmitBlock(ctx context.Context, in
 	return out, nil
 }
 
+func (c *incomingCommunicatorServiceClient) GetTransactionStatus(ctx context.Context, in *TransactionStatusRequest, opts ...grpc.CallOption) (*TransactionStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TransactionStatusResponse)
+	err := c.cc.Invoke(ctx, IncomingCommunicatorService_GetTransactionStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incomingCommunicatorServiceClient) GetMerkleProof(ctx context.Context, in *MerkleProofRequest, opts ...grpc.CallOption) (*MerkleProofResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MerkleProofResponse)
+	err := c.cc.Invoke(ctx, IncomingCommunicatorService_GetMerkleProof_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incomingCommunicatorServiceClient) GetHeaders(ctx context.Context, in *HeadersRequest, opts ...grpc.CallOption) (*HeadersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HeadersResponse)
+	err := c.cc.Invoke(ctx, IncomingCommunicatorService_GetHeaders_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incomingCommunicatorServiceClient) Announce(ctx context.Context, in *Inventory, opts ...grpc.CallOption) (*InventoryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(InventoryResponse)
+	err := c.cc.Invoke(ctx, IncomingCommunicatorService_Announce_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incomingCommunicatorServiceClient) SubmitCompactBlock(ctx context.Context, in *CompactBlock, opts ...grpc.CallOption) (*CompactBlockResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CompactBlockResponse)
+	err := c.cc.Invoke(ctx, IncomingCommunicatorService_SubmitCompactBlock_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // IncomingCommunicatorServiceServer is the server API for IncomingCommunicatorService service.
 // All implementations must embed UnimplementedIncomingCommunicatorServiceServer
 // for forward compatibility.
@@ -87,7 +154,19 @@ type IncomingCommunicatorServiceServer interface {
 	// Submit new transaction
 	SubmitTransaction(context.Context, *Transaction) (*TxResponse, error)
 	// Submit new block
-	SubmitBlock(context.Context, *BlockWithHeaders) (*BlockResponse, error)
+	SubmitBlock(context.Context, *BlockSubmission) (*BlockResponse, error)
+	// Gets a transactions Status
+	GetTransactionStatus(context.Context, *TransactionStatusRequest) (*TransactionStatusResponse, error)
+	// Gets a proof that a transaction is included in a main chain block
+	GetMerkleProof(context.Context, *MerkleProofRequest) (*MerkleProofResponse, error)
+	// Gets the main chain headers following the newest block of a locator
+	GetHeaders(context.Context, *HeadersRequest) (*HeadersResponse, error)
+	// Announces blocks and transactions by hash, the response lists the ones the
+	// receiver wants sent with SubmitCompactBlock or SubmitTransaction
+	Announce(context.Context, *Inventory) (*InventoryResponse, error)
+	// Submits a block as its header and short transaction ids, the response lists
+	// the transactions the receiver could not find in its pool
+	SubmitCompactBlock(context.Context, *CompactBlock) (*CompactBlockResponse, error)
 	mustEmbedUnimplementedIncomingCommunicatorServiceServer()
 }
 
@@ -104,9 +183,24 @@ func (UnimplementedIncomingCommunicatorServiceServer) GetBlockByHash(context.Con
 func (UnimplementedIncomingCommunicatorServiceServer) SubmitTransaction(context.Context, *Transaction) (*TxResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SubmitTransaction not implemented")
 }
-func (UnimplementedIncomingCommunicatorServiceServer) SubmitBlock(context.Context, *BlockWithHeaders) (*BlockResponse, error) {
+func (UnimplementedIncomingCommunicatorServiceServer) SubmitBlock(context.Context, *BlockSubmission) (*BlockResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SubmitBlock not implemented")
 }
+func (UnimplementedIncomingCommunicatorServiceServer) GetTransactionStatus(context.Context, *TransactionStatusRequest) (*TransactionStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTransactionStatus not implemented")
+}
+func (UnimplementedIncomingCommunicatorServiceServer) GetMerkleProof(context.Context, *MerkleProofRequest) (*MerkleProofResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMerkleProof not implemented")
+}
+func (UnimplementedIncomingCommunicatorServiceServer) GetHeaders(context.Context, *HeadersRequest) (*HeadersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetHeaders not implemented")
+}
+func (UnimplementedIncomingCommunicatorServiceServer) Announce(context.Context, *Inventory) (*InventoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Announce not implemented")
+}
+func (UnimplementedIncomingCommunicatorServiceServer) SubmitCompactBlock(context.Context, *CompactBlock) (*CompactBlockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitCompactBlock not implemented")
+}
 func (UnimplementedIncomingCommunicatorServiceServer) mustEmbedUnimplementedIncomingCommunicatorServiceServer() {
 }
 func (UnimplementedIncomingCommunicatorServiceServer) testEmbeddedByValue() {}
@@ -166,7 +260,7 @@ func _IncomingCommunicatorService_SubmitTransaction_Handler(srv interface{}, ctx
 }
 
 func _IncomingCommunicatorService_SubmitBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(BlockWithHeaders)
+	in := new(BlockSubmission)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -178,7 +272,97 @@ func _IncomingCommunicatorService_SubmitBlock_Handler(srv interface{}, ctx conte
 		FullMethod: IncomingCommunicatorService_SubmitBlock_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(IncomingCommunicatorServiceServer).SubmitBlock(ctx, req.(*BlockWithHeaders))
+		return srv.(IncomingCommunicatorServiceServer).SubmitBlock(ctx, req.(*BlockSubmission))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncomingCommunicatorService_GetTransactionStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransactionStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncomingCommunicatorServiceServer).GetTransactionStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IncomingCommunicatorService_GetTransactionStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncomingCommunicatorServiceServer).GetTransactionStatus(ctx, req.(*TransactionStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncomingCommunicatorService_GetMerkleProof_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MerkleProofRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncomingCommunicatorServiceServer).GetMerkleProof(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IncomingCommunicatorService_GetMerkleProof_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncomingCommunicatorServiceServer).GetMerkleProof(ctx, req.(*MerkleProofRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncomingCommunicatorService_GetHeaders_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeadersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncomingCommunicatorServiceServer).GetHeaders(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IncomingCommunicatorService_GetHeaders_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncomingCommunicatorServiceServer).GetHeaders(ctx, req.(*HeadersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncomingCommunicatorService_Announce_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Inventory)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncomingCommunicatorServiceServer).Announce(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IncomingCommunicatorService_Announce_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncomingCommunicatorServiceServer).Announce(ctx, req.(*Inventory))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncomingCommunicatorService_SubmitCompactBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompactBlock)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncomingCommunicatorServiceServer).SubmitCompactBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IncomingCommunicatorService_SubmitCompactBlock_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncomingCommunicatorServiceServer).SubmitCompactBlock(ctx, req.(*CompactBlock))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -202,6 +386,26 @@ var IncomingCommunicatorService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "SubmitBlock",
 			Handler:    _IncomingCommunicatorService_SubmitBlock_Handler,
 		},
+		{
+			MethodName: "GetTransactionStatus",
+			Handler:    _IncomingCommunicatorService_GetTransactionStatus_Handler,
+		},
+		{
+			MethodName: "GetMerkleProof",
+			Handler:    _IncomingCommunicatorService_GetMerkleProof_Handler,
+		},
+		{
+			MethodName: "GetHeaders",
+			Handler:    _IncomingCommunicatorService_GetHeaders_Handler,
+		},
+		{
+			MethodName: "Announce",
+			Handler:    _IncomingCommunicatorService_Announce_Handler,
+		},
+		{
+			MethodName: "SubmitCompactBlock",
+			Handler:    _IncomingCommunicatorService_SubmitCompactBlock_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/blockchain.proto",